@@ -0,0 +1,40 @@
+// Command check-integrity reports the enrollments whose user or course does
+// not exist. They must be fixed before the migrations can add the foreign keys.
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/enrollment"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/bootstrap"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	godotenv.Load()
+	logger := bootstrap.InitLogger()
+	db, err := bootstrap.OpenDB()
+
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	enrollmentRepository := enrollment.NewRepository(logger, db)
+	orphans, err := enrollmentRepository.Orphans()
+
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for _, orphan := range orphans {
+		encoder.Encode(orphan)
+	}
+
+	logger.Printf("%d orphan enrollments found", len(orphans))
+
+	if len(orphans) > 0 {
+		os.Exit(1)
+	}
+}
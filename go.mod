@@ -2,15 +2,20 @@ module github.com/S3ergio31/curso-go-seccion-4
 
 go 1.24.2
 
+require (
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/mux v1.8.1
+	github.com/joho/godotenv v1.5.1
+	github.com/nyaruka/phonenumbers v1.8.1
+	golang.org/x/text v0.28.0
+	gorm.io/driver/mysql v1.6.0
+	gorm.io/gorm v1.30.3
+)
+
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/go-sql-driver/mysql v1.9.3 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/text v0.28.0 // indirect
-	gorm.io/driver/mysql v1.6.0 // indirect
-	gorm.io/gorm v1.30.3 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
 )
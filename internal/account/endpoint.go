@@ -0,0 +1,243 @@
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/body"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/password"
+)
+
+type Controller func(w http.ResponseWriter, r *http.Request)
+
+type Endpoints struct {
+	RequestVerification Controller
+	VerifyEmail         Controller
+	ForgotPassword      Controller
+	ResetPassword       Controller
+	Login               Controller
+	Logout              Controller
+}
+
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// SessionResponse carries the session token, only returned by the login.
+type SessionResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Response struct {
+	Status int        `json:"status"`
+	Data   any        `json:"data,omitempty"`
+	Err    string     `json:"error,omitempty"`
+	Meta   *meta.Meta `json:"meta,omitempty"`
+}
+
+func MakeEndpoints(s Service) Endpoints {
+	return Endpoints{
+		RequestVerification: makeRequestVerificationEndpoint(s),
+		VerifyEmail:         makeVerifyEmailEndpoint(s),
+		ForgotPassword:      makeForgotPasswordEndpoint(s),
+		ResetPassword:       makeResetPasswordEndpoint(s),
+		Login:               makeLoginEndpoint(s),
+		Logout:              makeLogoutEndpoint(s),
+	}
+}
+
+func makeRequestVerificationEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var emailRequest EmailRequest
+
+		if err := body.Decode(r, &emailRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if emailRequest.Email == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "email is required"})
+			return
+		}
+
+		if err := s.RequestVerification(emailRequest.Email); err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func makeVerifyEmailEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var verifyRequest VerifyEmailRequest
+
+		if err := body.Decode(r, &verifyRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if verifyRequest.Token == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "token is required"})
+			return
+		}
+
+		if err := s.WithContext(r.Context()).VerifyEmail(verifyRequest.Token); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func makeForgotPasswordEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var emailRequest EmailRequest
+
+		if err := body.Decode(r, &emailRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if emailRequest.Email == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "email is required"})
+			return
+		}
+
+		if err := s.ForgotPassword(emailRequest.Email); err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func makeResetPasswordEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resetRequest ResetPasswordRequest
+
+		if err := body.Decode(r, &resetRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if resetRequest.Token == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "token is required"})
+			return
+		}
+
+		err := s.WithContext(r.Context()).ResetPassword(resetRequest.Token, resetRequest.Password)
+
+		if errors.Is(err, ErrInvalidToken) || errors.Is(err, password.ErrTooShort) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func makeLoginEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var loginRequest LoginRequest
+
+		if err := body.Decode(r, &loginRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if loginRequest.Email == "" || loginRequest.Password == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "email and password are required"})
+			return
+		}
+
+		token, session, err := s.Login(loginRequest.Email, loginRequest.Password)
+
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(Response{Status: 401, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: SessionResponse{Token: token, ExpiresAt: session.ExpiresAt}})
+	}
+}
+
+// makeLogoutEndpoint ends the session of the Bearer token sent, the auth
+// routes are public so the middleware does not read it.
+func makeLogoutEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+
+		if !strings.EqualFold(scheme, Scheme) || strings.TrimSpace(token) == "" {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(Response{Status: 401, Err: "session token is required"})
+			return
+		}
+
+		err := s.Logout(strings.TrimSpace(token))
+
+		if errors.Is(err, ErrInvalidToken) {
+			w.WriteHeader(401)
+			json.NewEncoder(w).Encode(Response{Status: 401, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
@@ -0,0 +1,114 @@
+package account
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"gorm.io/gorm"
+)
+
+type Repository interface {
+	CreateToken(token *domain.UserToken) error
+	GetToken(hash, purpose string) (*domain.UserToken, error)
+	VerifyEmail(token *domain.UserToken) error
+	ResetPassword(token *domain.UserToken, passwordHash string) error
+	UseToken(token *domain.UserToken) error
+	WithTx(tx *gorm.DB) Repository
+	WithContext(ctx context.Context) Repository
+}
+
+type repository struct {
+	logger *log.Logger
+	db     *gorm.DB
+}
+
+func (r repository) CreateToken(token *domain.UserToken) error {
+	if err := r.db.Create(token).Error; err != nil {
+		r.logger.Println(err)
+		return err
+	}
+
+	r.logger.Println("user token created with id: ", token.ID)
+	return nil
+}
+
+func (r repository) GetToken(hash, purpose string) (*domain.UserToken, error) {
+	var token domain.UserToken
+	if err := r.db.Where("hash = ? AND purpose = ?", hash, purpose).First(&token).Error; err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r repository) VerifyEmail(token *domain.UserToken) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		if err := useToken(tx, token, now); err != nil {
+			return err
+		}
+
+		return tx.Model(&domain.User{}).
+			Where("id = ?", token.UserID).
+			Updates(map[string]any{"email_verified_at": now, "version": gorm.Expr("version + 1")}).Error
+	})
+}
+
+func (r repository) ResetPassword(token *domain.UserToken, passwordHash string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		if err := useToken(tx, token, now); err != nil {
+			return err
+		}
+
+		// any other reset link sent before, and every session, is no longer valid
+		if err := tx.Model(&domain.UserToken{}).
+			Where("user_id = ? AND purpose IN ? AND used_at IS NULL", token.UserID, []string{token.Purpose, domain.TokenSession}).
+			Update("used_at", now).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&domain.User{}).
+			Where("id = ?", token.UserID).
+			Updates(map[string]any{"password_hash": passwordHash, "version": gorm.Expr("version + 1")}).Error
+	})
+}
+
+func (r repository) UseToken(token *domain.UserToken) error {
+	return useToken(r.db, token, time.Now())
+}
+
+// useToken marks the token as used, failing when a concurrent request
+// already consumed it.
+func useToken(tx *gorm.DB, token *domain.UserToken, now time.Time) error {
+	result := tx.Model(&domain.UserToken{}).
+		Where("id = ? AND used_at IS NULL", token.ID).
+		Update("used_at", now)
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// WithTx keeps the context of the repository, the transaction may have been
+// started from a db without it.
+func (r repository) WithTx(tx *gorm.DB) Repository {
+	return &repository{logger: r.logger, db: tx.WithContext(r.db.Statement.Context)}
+}
+
+func (r repository) WithContext(ctx context.Context) Repository {
+	return &repository{logger: r.logger, db: r.db.WithContext(ctx)}
+}
+
+func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
+	return &repository{logger: logger, db: db}
+}
@@ -0,0 +1,300 @@
+package account
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/audit"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/user"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/mailer"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/password"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
+	"gorm.io/gorm"
+)
+
+// Scheme is the authorization scheme of the session tokens issued by Login.
+const Scheme = "Bearer"
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// dummyHash is compared when the user does not exist or has no password, so
+// a login takes as long whether the email is registered or not.
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := password.Hash("dummy password")
+	return hash
+})
+
+type Service interface {
+	RequestVerification(email string) error
+	VerifyEmail(token string) error
+	ForgotPassword(email string) error
+	ResetPassword(token, newPassword string) error
+	// Login issues a session token for the user, accepted with the Bearer
+	// scheme next to API keys.
+	Login(email, plain string) (string, *domain.UserToken, error)
+	Logout(token string) error
+	Authenticate(credentials string) (*auth.Principal, error)
+	WithContext(ctx context.Context) Service
+}
+
+type service struct {
+	logger      *log.Logger
+	repository  Repository
+	userService user.Service
+	mailer      mailer.Mailer
+	verifyTTL   time.Duration
+	resetTTL    time.Duration
+	sessionTTL  time.Duration
+	userScopes  []string
+	uow         uow.UnitOfWork
+	audit       audit.Recorder
+}
+
+// RequestVerification and ForgotPassword never tell whether the email
+// exists: the lookup and the mail happen in the background, so neither the
+// answer nor the time it takes depends on it. Unknown or already verified
+// addresses, like failures, are only logged.
+func (s service) RequestVerification(email string) error {
+	go s.background(func() error { return s.requestVerification(email) })
+	return nil
+}
+
+func (s service) requestVerification(email string) error {
+	u, err := s.userService.GetByEmail(email)
+
+	if err != nil {
+		s.logger.Println(err)
+		return nil
+	}
+
+	if u.EmailVerifiedAt != nil {
+		s.logger.Println("email already verified for user: ", u.ID)
+		return nil
+	}
+
+	token, err := s.issueToken(u.ID, domain.TokenVerifyEmail, s.verifyTTL)
+
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(u.Email, "Verify your email", fmt.Sprintf(
+		"Hi %s,\n\nUse the following token to verify your email, it expires in %s:\n\n%s\n",
+		u.FirstName, s.verifyTTL, token,
+	))
+}
+
+func (s service) VerifyEmail(token string) error {
+	t, err := s.getToken(token, domain.TokenVerifyEmail)
+
+	if err != nil {
+		return err
+	}
+
+	return s.updateUser(t.UserID, func(repository Repository) error {
+		return repository.VerifyEmail(t)
+	})
+}
+
+func (s service) ForgotPassword(email string) error {
+	go s.background(func() error { return s.forgotPassword(email) })
+	return nil
+}
+
+func (s service) forgotPassword(email string) error {
+	u, err := s.userService.GetByEmail(email)
+
+	if err != nil {
+		s.logger.Println(err)
+		return nil
+	}
+
+	token, err := s.issueToken(u.ID, domain.TokenResetPassword, s.resetTTL)
+
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(u.Email, "Reset your password", fmt.Sprintf(
+		"Hi %s,\n\nUse the following token to choose a new password, it expires in %s:\n\n%s\n\n"+
+			"If you did not ask for it you can ignore this email.\n",
+		u.FirstName, s.resetTTL, token,
+	))
+}
+
+// ResetPassword checks the token before hashing, hashing is deliberately
+// slow and must not be available to anonymous requests without a token.
+func (s service) ResetPassword(token, newPassword string) error {
+	t, err := s.getToken(token, domain.TokenResetPassword)
+
+	if err != nil {
+		return err
+	}
+
+	hash, err := password.Hash(newPassword)
+
+	if err != nil {
+		return err
+	}
+
+	return s.updateUser(t.UserID, func(repository Repository) error {
+		return repository.ResetPassword(t, hash)
+	})
+}
+
+func (s service) Login(email, plain string) (string, *domain.UserToken, error) {
+	u, err := s.userService.GetByEmail(email)
+
+	if err != nil || u.PasswordHash == "" {
+		password.Compare(dummyHash(), plain)
+		return "", nil, auth.ErrInvalidCredentials
+	}
+
+	if ok, err := password.Compare(u.PasswordHash, plain); err != nil || !ok {
+		return "", nil, auth.ErrInvalidCredentials
+	}
+
+	return s.createToken(u.ID, domain.TokenSession, s.sessionTTL)
+}
+
+func (s service) Logout(token string) error {
+	t, err := s.getToken(token, domain.TokenSession)
+
+	if err != nil {
+		return err
+	}
+
+	return s.repository.UseToken(t)
+}
+
+// Authenticate resolves a session token into the principal of its user, who
+// gets the scopes configured for users.
+func (s service) Authenticate(credentials string) (*auth.Principal, error) {
+	t, err := s.getToken(credentials, domain.TokenSession)
+
+	if err != nil {
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	u, err := s.userService.Get(t.UserID)
+
+	if err != nil {
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	return &auth.Principal{ID: u.ID, Name: u.FirstName + " " + u.LastName, Type: "user", Scopes: s.userScopes}, nil
+}
+
+func (s service) background(fn func() error) {
+	if err := fn(); err != nil {
+		s.logger.Println(err)
+	}
+}
+
+// updateUser runs an update of the user in a unit of work that audits it.
+func (s service) updateUser(id string, update func(repository Repository) error) error {
+	return s.uow.Do(func(tx *gorm.DB) error {
+		users := s.userService.WithTx(tx)
+		before, err := users.GetForUpdate(id)
+
+		if err != nil {
+			return err
+		}
+
+		if err := update(s.repository.WithTx(tx)); err != nil {
+			return err
+		}
+
+		after, err := users.Get(id)
+
+		if err != nil {
+			return err
+		}
+
+		return s.audit.WithTx(tx).Record("user", id, audit.ActionUpdate, before, after)
+	})
+}
+
+func (s service) issueToken(userID, purpose string, ttl time.Duration) (string, error) {
+	plain, _, err := s.createToken(userID, purpose, ttl)
+	return plain, err
+}
+
+func (s service) createToken(userID, purpose string, ttl time.Duration) (string, *domain.UserToken, error) {
+	buf := make([]byte, 32)
+
+	if _, err := rand.Read(buf); err != nil {
+		s.logger.Println(err)
+		return "", nil, err
+	}
+
+	plain := hex.EncodeToString(buf)
+	token := &domain.UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		Hash:      hashToken(plain),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	if err := s.repository.CreateToken(token); err != nil {
+		return "", nil, err
+	}
+
+	return plain, token, nil
+}
+
+func (s service) getToken(plain, purpose string) (*domain.UserToken, error) {
+	t, err := s.repository.GetToken(hashToken(plain), purpose)
+
+	if err != nil || t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+
+	return t, nil
+}
+
+// WithContext returns a copy of the service bound to the request context.
+func (s service) WithContext(ctx context.Context) Service {
+	s.repository = s.repository.WithContext(ctx)
+	s.userService = s.userService.WithContext(ctx)
+	s.audit = s.audit.WithContext(ctx)
+	return &s
+}
+
+func NewService(
+	repository Repository,
+	logger *log.Logger,
+	userService user.Service,
+	mailer mailer.Mailer,
+	verifyTTL, resetTTL, sessionTTL time.Duration,
+	userScopes []string,
+	unitOfWork uow.UnitOfWork,
+	recorder audit.Recorder,
+) Service {
+	return &service{
+		logger:      logger,
+		repository:  repository,
+		userService: userService,
+		mailer:      mailer,
+		verifyTTL:   verifyTTL,
+		resetTTL:    resetTTL,
+		sessionTTL:  sessionTTL,
+		userScopes:  userScopes,
+		uow:         unitOfWork,
+		audit:       recorder,
+	}
+}
+
+func hashToken(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,174 @@
+package apikey
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/body"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+type Controller func(w http.ResponseWriter, r *http.Request)
+
+type Endpoints struct {
+	Create Controller
+	Get    Controller
+	GetAll Controller
+	Revoke Controller
+	Rotate Controller
+}
+
+type CreateRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// SecretResponse is returned by create and rotate, the only moments where the
+// plain key is available.
+type SecretResponse struct {
+	*domain.APIKey
+	Key string `json:"key"`
+}
+
+type Response struct {
+	Status int        `json:"status"`
+	Data   any        `json:"data,omitempty"`
+	Err    string     `json:"error,omitempty"`
+	Meta   *meta.Meta `json:"meta,omitempty"`
+}
+
+func MakeEndpoints(s Service) Endpoints {
+	return Endpoints{
+		Create: makeCreateEndpoint(s),
+		Get:    makeGetEndpoint(s),
+		GetAll: makeGetAllEndpoint(s),
+		Revoke: makeRevokeEndpoint(s),
+		Rotate: makeRotateEndpoint(s),
+	}
+}
+
+func makeCreateEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var createRequest CreateRequest
+
+		if err := body.Decode(r, &createRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if createRequest.Name == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "name is required"})
+			return
+		}
+
+		key, secret, err := s.Create(auth.FromContext(r.Context()), createRequest.Name, createRequest.Scopes)
+
+		if errors.Is(err, ErrScopeNotHeld) {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: SecretResponse{APIKey: key, Key: secret}})
+	}
+}
+
+func makeGetEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+		key, err := s.Get(id)
+
+		if err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "api key does not exist"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: key})
+	}
+}
+
+func makeGetAllEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := s.GetAll()
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: keys})
+	}
+}
+
+func makeRevokeEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+
+		err := s.Revoke(auth.FromContext(r.Context()), id)
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "api key does not exist"})
+			return
+		}
+
+		if errors.Is(err, ErrScopeNotHeld) {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func makeRotateEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+		key, secret, err := s.Rotate(auth.FromContext(r.Context()), id)
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "api key does not exist"})
+			return
+		}
+
+		if errors.Is(err, ErrScopeNotHeld) {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: SecretResponse{APIKey: key, Key: secret}})
+	}
+}
@@ -0,0 +1,103 @@
+package apikey
+
+import (
+	"log"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"gorm.io/gorm"
+)
+
+type Repository interface {
+	Create(key *domain.APIKey) error
+	GetAll() ([]domain.APIKey, error)
+	Get(id string) (*domain.APIKey, error)
+	GetByHash(hash string) (*domain.APIKey, error)
+	Revoke(id string) error
+	Rotate(id, prefix, hash string) error
+	Touch(id string, usedAt time.Time) error
+}
+
+type repository struct {
+	logger *log.Logger
+	db     *gorm.DB
+}
+
+func (r repository) Create(key *domain.APIKey) error {
+	if err := r.db.Create(key).Error; err != nil {
+		r.logger.Println(err)
+		return err
+	}
+
+	r.logger.Println("api key created with id: ", key.ID)
+	return nil
+}
+
+func (r repository) GetAll() ([]domain.APIKey, error) {
+	var keys []domain.APIKey
+
+	if err := r.db.Order("created_at desc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r repository) Get(id string) (*domain.APIKey, error) {
+	key := domain.APIKey{ID: id}
+	if err := r.db.First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r repository) GetByHash(hash string) (*domain.APIKey, error) {
+	var key domain.APIKey
+	if err := r.db.Where("hash = ?", hash).First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r repository) Revoke(id string) error {
+	tx := r.db.Model(&domain.APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	r.logger.Println("api key revoked with id: ", id)
+	return nil
+}
+
+func (r repository) Rotate(id, prefix, hash string) error {
+	tx := r.db.Model(&domain.APIKey{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Updates(map[string]interface{}{"prefix": prefix, "hash": hash, "last_used_at": nil})
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	r.logger.Println("api key rotated with id: ", id)
+	return nil
+}
+
+func (r repository) Touch(id string, usedAt time.Time) error {
+	return r.db.Model(&domain.APIKey{}).
+		Where("id = ?", id).
+		UpdateColumn("last_used_at", usedAt).Error
+}
+
+func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
+	return &repository{logger: logger, db: db}
+}
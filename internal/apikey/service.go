@@ -0,0 +1,225 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+)
+
+const (
+	Scheme = "ApiKey"
+
+	keyPrefix = "ak_"
+	// adminType is the type of the principal authenticated with the admin key.
+	adminType = "admin"
+	// lastUsedPrecision avoids writing last_used_at on every single request.
+	lastUsedPrecision = time.Minute
+	// maxNameLength and maxScopesLength are the sizes of the columns.
+	maxNameLength   = 50
+	maxScopesLength = 255
+)
+
+var scopePattern = regexp.MustCompile(`^[a-z_]+:(read|write)$`)
+
+// ErrScopeNotHeld is returned when a principal grants a scope it does not
+// hold itself, only the admin principal grants every scope.
+var ErrScopeNotHeld = errors.New("can not grant a scope you do not hold")
+
+type Service interface {
+	// Create issues a key on behalf of the creator, limited to the scopes
+	// the creator holds.
+	Create(creator *auth.Principal, name string, scopes []string) (*domain.APIKey, string, error)
+	GetAll() ([]domain.APIKey, error)
+	Get(id string) (*domain.APIKey, error)
+	// Revoke and Rotate are limited to the keys whose scopes the principal
+	// could grant, so a key can not take over a more powerful one.
+	Revoke(principal *auth.Principal, id string) error
+	Rotate(principal *auth.Principal, id string) (*domain.APIKey, string, error)
+	Authenticate(credentials string) (*auth.Principal, error)
+}
+
+type service struct {
+	logger     *log.Logger
+	repository Repository
+	adminKey   string
+}
+
+func (s service) Create(creator *auth.Principal, name string, scopes []string) (*domain.APIKey, string, error) {
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return nil, "", fmt.Errorf("name must have at most %d characters", maxNameLength)
+	}
+
+	if err := validateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	if err := canGrant(creator, scopes); err != nil {
+		return nil, "", err
+	}
+
+	prefix, secret, err := generate()
+
+	if err != nil {
+		s.logger.Println(err)
+		return nil, "", err
+	}
+
+	key := &domain.APIKey{
+		Name:   name,
+		Prefix: prefix,
+		Hash:   hash(secret),
+		Scopes: scopes,
+	}
+
+	if err := s.repository.Create(key); err != nil {
+		return nil, "", err
+	}
+
+	return key, secret, nil
+}
+
+func (s service) GetAll() ([]domain.APIKey, error) {
+	return s.repository.GetAll()
+}
+
+func (s service) Get(id string) (*domain.APIKey, error) {
+	return s.repository.Get(id)
+}
+
+func (s service) Revoke(principal *auth.Principal, id string) error {
+	if err := s.canManage(principal, id); err != nil {
+		return err
+	}
+
+	return s.repository.Revoke(id)
+}
+
+func (s service) Rotate(principal *auth.Principal, id string) (*domain.APIKey, string, error) {
+	if err := s.canManage(principal, id); err != nil {
+		return nil, "", err
+	}
+
+	prefix, secret, err := generate()
+
+	if err != nil {
+		s.logger.Println(err)
+		return nil, "", err
+	}
+
+	if err := s.repository.Rotate(id, prefix, hash(secret)); err != nil {
+		return nil, "", err
+	}
+
+	key, err := s.repository.Get(id)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return key, secret, nil
+}
+
+func (s service) Authenticate(credentials string) (*auth.Principal, error) {
+	if credentials == "" {
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	if s.adminKey != "" && subtle.ConstantTimeCompare([]byte(credentials), []byte(s.adminKey)) == 1 {
+		return &auth.Principal{ID: "admin", Name: "admin", Type: adminType, Scopes: []string{auth.AllScopes}}, nil
+	}
+
+	key, err := s.repository.GetByHash(hash(credentials))
+
+	if err != nil || key.RevokedAt != nil {
+		return nil, auth.ErrInvalidCredentials
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > lastUsedPrecision {
+		if err := s.repository.Touch(key.ID, now); err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	return &auth.Principal{ID: key.ID, Name: key.Name, Type: "api_key", Scopes: key.Scopes}, nil
+}
+
+// canManage checks the principal could have granted the scopes of the key.
+func (s service) canManage(principal *auth.Principal, id string) error {
+	key, err := s.repository.Get(id)
+
+	if err != nil {
+		return err
+	}
+
+	return canGrant(principal, key.Scopes)
+}
+
+func NewService(repository Repository, logger *log.Logger, adminKey string) Service {
+	return &service{logger: logger, repository: repository, adminKey: adminKey}
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("at least one scope is required")
+	}
+
+	for _, scope := range scopes {
+		if scope != auth.AllScopes && !scopePattern.MatchString(scope) {
+			return errors.New("invalid scope " + scope)
+		}
+	}
+
+	if len(strings.Join(scopes, ",")) > maxScopesLength {
+		return fmt.Errorf("scopes must have at most %d characters", maxScopesLength)
+	}
+	return nil
+}
+
+// canGrant keeps keys from promoting themselves: each scope must be held by
+// the creator, and "*" can only be granted by the admin principal.
+func canGrant(creator *auth.Principal, scopes []string) error {
+	if creator == nil {
+		return ErrScopeNotHeld
+	}
+
+	for _, scope := range scopes {
+		if scope == auth.AllScopes && creator.Type != adminType {
+			return fmt.Errorf("%w: %s", ErrScopeNotHeld, scope)
+		}
+
+		if !creator.Can(scope) {
+			return fmt.Errorf("%w: %s", ErrScopeNotHeld, scope)
+		}
+	}
+	return nil
+}
+
+// generate returns the public prefix and the full secret of a new key. The
+// secret is only shown once, the database keeps its sha256 hash.
+func generate() (string, string, error) {
+	buf := make([]byte, 36)
+
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	prefix := keyPrefix + hex.EncodeToString(buf[:4])
+	return prefix, prefix + "." + hex.EncodeToString(buf[4:]), nil
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(secret)))
+	return hex.EncodeToString(sum[:])
+}
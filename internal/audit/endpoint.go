@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+)
+
+type Controller func(w http.ResponseWriter, r *http.Request)
+
+// filterable are the fields accepted by the filter parameters of lists.
+var filterable = filter.Schema{
+	"entity":     {Column: "entity"},
+	"entity_id":  {Column: "entity_id"},
+	"action":     {Column: "action"},
+	"actor":      {Column: "actor"},
+	"request_id": {Column: "request_id"},
+	"created_at": {Column: "created_at", Kind: filter.Time},
+}
+
+type Endpoints struct {
+	GetAll Controller
+}
+
+type Response struct {
+	Status int        `json:"status"`
+	Data   any        `json:"data,omitempty"`
+	Err    string     `json:"error,omitempty"`
+	Meta   *meta.Meta `json:"meta,omitempty"`
+}
+
+func MakeEndpoints(s Service) Endpoints {
+	return Endpoints{
+		GetAll: makeGetAllEndpoint(s),
+	}
+}
+
+func makeGetAllEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filters := Filters{
+			Entity:   query.Get("entity"),
+			EntityID: query.Get("id"),
+			Actor:    query.Get("actor"),
+		}
+
+		conditions, err := filter.Parse(query, filterable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		filters.Conditions = conditions
+
+		count, err := s.Count(filters)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page, _ := strconv.Atoi(query.Get("page"))
+		meta, err := meta.New(page, limit, count)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		entries, err := s.GetAll(filters, meta.Offset(), meta.Limit())
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		listing.Link(w, r, meta)
+
+		json.NewEncoder(w).Encode(Response{
+			Status: 200,
+			Data:   entries,
+			Meta:   meta,
+		})
+	}
+}
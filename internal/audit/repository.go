@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"context"
+	"log"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"gorm.io/gorm"
+)
+
+// Repository has no update nor delete on purpose, the log is append-only.
+type Repository interface {
+	Create(entry *domain.AuditLog) error
+	// CreateEvent appends to the outbox of the change feed.
+	CreateEvent(event *domain.ChangeEvent) error
+	GetAll(filters Filters, offset, limit int) ([]domain.AuditLog, error)
+	Count(filters Filters) (int, error)
+	WithTx(tx *gorm.DB) Repository
+	WithContext(ctx context.Context) Repository
+}
+
+type repository struct {
+	logger *log.Logger
+	db     *gorm.DB
+}
+
+func (r repository) Create(entry *domain.AuditLog) error {
+	if err := r.db.Create(entry).Error; err != nil {
+		r.logger.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (r repository) CreateEvent(event *domain.ChangeEvent) error {
+	if err := r.db.Create(event).Error; err != nil {
+		r.logger.Println(err)
+		return err
+	}
+	return nil
+}
+
+func (r repository) GetAll(filters Filters, offset, limit int) ([]domain.AuditLog, error) {
+	var entries []domain.AuditLog
+
+	tx := r.db.Model(&entries)
+
+	tx = applyFilters(tx, filters)
+
+	tx = tx.Limit(limit).Offset(offset)
+
+	if err := tx.Order("id desc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r repository) Count(filters Filters) (int, error) {
+	var count int64
+
+	tx := r.db.Model(domain.AuditLog{})
+
+	tx = applyFilters(tx, filters)
+
+	if err := tx.Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (r repository) WithTx(tx *gorm.DB) Repository {
+	return &repository{logger: r.logger, db: tx.WithContext(r.db.Statement.Context)}
+}
+
+func (r repository) WithContext(ctx context.Context) Repository {
+	return &repository{logger: r.logger, db: r.db.WithContext(ctx)}
+}
+
+func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
+	return &repository{logger: logger, db: db}
+}
+
+func applyFilters(tx *gorm.DB, filters Filters) *gorm.DB {
+	if filters.Entity != "" {
+		tx = tx.Where("entity = ?", filters.Entity)
+	}
+
+	if filters.EntityID != "" {
+		tx = tx.Where("entity_id = ?", filters.EntityID)
+	}
+
+	if filters.Actor != "" {
+		tx = tx.Where("actor = ?", filters.Actor)
+	}
+
+	tx = filter.Apply(tx, filters.Conditions)
+
+	return tx
+}
@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"reflect"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/requestid"
+	"gorm.io/gorm"
+)
+
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+)
+
+// Recorder is what the other services need to log their mutations.
+type Recorder interface {
+	// Record stores the fields that differ between before and after, either
+	// can be nil. It is called in the transaction of the mutation, see WithTx,
+	// and an error must roll the mutation back: nothing changes unaudited.
+	// The change feed reads the events it appends too, see internal/change.
+	Record(entity, id, action string, before, after any) error
+	// WithTx records in the transaction of the mutation, so rolled back
+	// mutations leave no entry.
+	WithTx(tx *gorm.DB) Recorder
+	WithContext(ctx context.Context) Recorder
+}
+
+type Service interface {
+	Recorder
+	GetAll(filters Filters, offset, limit int) ([]domain.AuditLog, error)
+	Count(filters Filters) (int, error)
+}
+
+type Filters struct {
+	Entity   string
+	EntityID string
+	Actor    string
+	// Conditions come from the filter[field][operator] parameters.
+	Conditions []filter.Condition
+}
+
+type service struct {
+	logger     *log.Logger
+	repository Repository
+	ctx        context.Context
+}
+
+func (s service) Record(entity, id, action string, before, after any) error {
+	changes, err := diff(before, after)
+
+	if err != nil {
+		s.logger.Println(err)
+		return err
+	}
+
+	entry := &domain.AuditLog{
+		RequestID: requestid.FromContext(s.ctx),
+		Entity:    entity,
+		EntityID:  id,
+		Action:    action,
+		Changes:   changes,
+	}
+
+	if p := auth.FromContext(s.ctx); p != nil {
+		entry.Actor = p.ID
+	}
+
+	if err := s.repository.Create(entry); err != nil {
+		s.logger.Printf("audit of %s %s %s failed: %v", action, entity, id, err)
+		return err
+	}
+
+	event, err := changeEvent(entity, id, action, before, after)
+
+	if err != nil {
+		s.logger.Println(err)
+		return err
+	}
+
+	return s.repository.CreateEvent(event)
+}
+
+// changeEvent maps an audited action to the event of the change feed, it
+// carries the last state of the row, none once it is purged.
+func changeEvent(entity, id, action string, before, after any) (*domain.ChangeEvent, error) {
+	switch action {
+	case ActionCreate:
+		return domain.NewChangeEvent(entity, id, domain.ChangeCreated, after)
+	case ActionDelete:
+		return domain.NewChangeEvent(entity, id, domain.ChangeDeleted, before)
+	case ActionPurge:
+		return domain.NewChangeEvent(entity, id, domain.ChangeDeleted, nil)
+	default:
+		return domain.NewChangeEvent(entity, id, domain.ChangeUpdated, after)
+	}
+}
+
+func (s service) GetAll(filters Filters, offset, limit int) ([]domain.AuditLog, error) {
+	return s.repository.GetAll(filters, offset, limit)
+}
+
+func (s service) Count(filters Filters) (int, error) {
+	return s.repository.Count(filters)
+}
+
+func (s service) WithTx(tx *gorm.DB) Recorder {
+	s.repository = s.repository.WithTx(tx)
+	return &s
+}
+
+func (s service) WithContext(ctx context.Context) Recorder {
+	s.repository = s.repository.WithContext(ctx)
+	s.ctx = ctx
+	return &s
+}
+
+func NewService(repository Repository, logger *log.Logger) Service {
+	return &service{logger: logger, repository: repository, ctx: context.Background()}
+}
+
+// diff compares the JSON representation of both values, so hidden fields
+// (password hashes, deletion dates) never reach the log.
+func diff(before, after any) (map[string]domain.FieldChange, error) {
+	beforeFields, err := fields(before)
+
+	if err != nil {
+		return nil, err
+	}
+
+	afterFields, err := fields(after)
+
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[string]domain.FieldChange)
+
+	for name, value := range beforeFields {
+		if other, ok := afterFields[name]; !ok || !reflect.DeepEqual(value, other) {
+			changes[name] = domain.FieldChange{Before: value, After: afterFields[name]}
+		}
+	}
+
+	for name, value := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			changes[name] = domain.FieldChange{After: value}
+		}
+	}
+
+	return changes, nil
+}
+
+func fields(value any) (map[string]any, error) {
+	result := make(map[string]any)
+
+	if v := reflect.ValueOf(value); !v.IsValid() || (v.Kind() == reflect.Pointer && v.IsNil()) {
+		return result, nil
+	}
+
+	raw, err := json.Marshal(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, json.Unmarshal(raw, &result)
+}
@@ -0,0 +1,63 @@
+package change
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+)
+
+const maxLimit = 1000
+
+type Controller func(w http.ResponseWriter, r *http.Request)
+
+type Endpoints struct {
+	GetAll Controller
+}
+
+type Feed struct {
+	Changes []Change `json:"changes"`
+	Next    string   `json:"next"`
+}
+
+type Response struct {
+	Status int        `json:"status"`
+	Data   any        `json:"data,omitempty"`
+	Err    string     `json:"error,omitempty"`
+	Meta   *meta.Meta `json:"meta,omitempty"`
+}
+
+func MakeEndpoints(s Service) Endpoints {
+	return Endpoints{
+		GetAll: makeGetAllEndpoint(s),
+	}
+}
+
+func makeGetAllEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+
+		if limit <= 0 || limit > maxLimit {
+			limit = maxLimit
+		}
+
+		changes, next, err := s.GetAll(query.Get("since"), limit)
+
+		if errors.Is(err, ErrInvalidCursor) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: Feed{Changes: changes, Next: next}})
+	}
+}
@@ -0,0 +1,92 @@
+package change
+
+import (
+	"log"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Repository interface {
+	GetAll(after uint64, limit int) ([]domain.ChangeEvent, error)
+}
+
+type repository struct {
+	logger *log.Logger
+	db     *gorm.DB
+}
+
+// GetAll numbers the events committed since the last call and returns up to
+// limit of them after the given sequence number.
+func (r repository) GetAll(after uint64, limit int) ([]domain.ChangeEvent, error) {
+	if err := r.sequence(limit); err != nil {
+		return nil, err
+	}
+
+	var events []domain.ChangeEvent
+
+	err := r.db.Where("seq > ?", after).
+		Order("seq").
+		Limit(limit).
+		Find(&events).Error
+
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// sequence gives the next numbers to up to limit committed events. Events of
+// transactions still running are locked and skipped, they are numbered
+// after they commit, so a long transaction can not be skipped by a consumer
+// that already read past its start.
+func (r repository) sequence(limit int) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		var last []uint64
+
+		// locks the end of the sequence, concurrent calls wait for each other.
+		err := tx.Model(&domain.ChangeEvent{}).
+			Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("seq IS NOT NULL").
+			Order("seq DESC").
+			Limit(1).
+			Pluck("seq", &last).Error
+
+		if err != nil {
+			return err
+		}
+
+		var ids []uint64
+
+		err = tx.Model(&domain.ChangeEvent{}).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("seq IS NULL").
+			Order("id").
+			Limit(limit).
+			Pluck("id", &ids).Error
+
+		if err != nil {
+			return err
+		}
+
+		var seq uint64
+
+		if len(last) > 0 {
+			seq = last[0]
+		}
+
+		for _, id := range ids {
+			seq++
+
+			if err := tx.Model(&domain.ChangeEvent{}).Where("id = ?", id).Update("seq", seq).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
+	return &repository{logger: logger, db: db}
+}
@@ -0,0 +1,113 @@
+package change
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+)
+
+const (
+	EntityCourse     = "course"
+	EntityEnrollment = "enrollment"
+	EntityUser       = "user"
+
+	ActionCreated = domain.ChangeCreated
+	ActionUpdated = domain.ChangeUpdated
+	ActionDeleted = domain.ChangeDeleted
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type Change struct {
+	Entity    string          `json:"entity"`
+	ID        string          `json:"id"`
+	Action    string          `json:"action"`
+	ChangedAt time.Time       `json:"changed_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Cursor is the position of the last change a consumer has seen, clients
+// only handle its opaque encoded form.
+type Cursor struct {
+	Seq uint64 `json:"s"`
+}
+
+type Service interface {
+	GetAll(since string, limit int) ([]Change, string, error)
+}
+
+type service struct {
+	logger     *log.Logger
+	repository Repository
+}
+
+// GetAll returns the changes after the since cursor and the cursor to resume
+// from. Changes are read from the outbox written with each audited mutation,
+// in the order they were committed.
+func (s service) GetAll(since string, limit int) ([]Change, string, error) {
+	cursor, err := DecodeCursor(since)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	events, err := s.repository.GetAll(cursor.Seq, limit)
+
+	if err != nil {
+		s.logger.Println(err)
+		return nil, "", err
+	}
+
+	if len(events) == 0 {
+		return []Change{}, since, nil
+	}
+
+	changes := make([]Change, 0, len(events))
+
+	for _, event := range events {
+		changes = append(changes, Change{
+			Entity:    event.Entity,
+			ID:        event.EntityID,
+			Action:    event.Action,
+			ChangedAt: event.ChangedAt,
+			Data:      event.Data,
+		})
+	}
+
+	return changes, Cursor{Seq: *events[len(events)-1].Seq}.Encode(), nil
+}
+
+func NewService(repository Repository, logger *log.Logger) Service {
+	return &service{logger: logger, repository: repository}
+}
+
+func (c Cursor) Encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// DecodeCursor returns the zero cursor, the beginning of the feed, for an
+// empty string.
+func DecodeCursor(encoded string) (Cursor, error) {
+	var cursor Cursor
+
+	if encoded == "" {
+		return cursor, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return cursor, ErrInvalidCursor
+	}
+
+	return cursor, nil
+}
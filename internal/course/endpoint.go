@@ -2,21 +2,56 @@ package course
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/batch"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/body"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/etag"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/export"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fields"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/httpcache"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
 	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 type Controller func(w http.ResponseWriter, r *http.Request)
 
+var (
+	// selectable are the fields accepted by the fields parameter.
+	selectable = []string{"id", "name", "start_date", "end_date", "version", "created_at", "updated_at", "created_by", "updated_by"}
+	// sortable are the fields accepted by the sort parameter of lists.
+	sortable = []string{"name", "start_date", "end_date", "created_at", "updated_at"}
+	// filterable are the fields accepted by the filter parameters of lists.
+	filterable = filter.Schema{
+		"name":       {Column: "name"},
+		"start_date": {Column: "start_date", Kind: filter.Time},
+		"end_date":   {Column: "end_date", Kind: filter.Time},
+		"version":    {Column: "version", Kind: filter.Int},
+		"created_at": {Column: "created_at", Kind: filter.Time},
+		"updated_at": {Column: "updated_at", Kind: filter.Time},
+		"created_by": {Column: "created_by"},
+		"updated_by": {Column: "updated_by"},
+	}
+	// defaultSort lists the newest first.
+	defaultSort = []listing.Order{{Column: "created_at", Desc: true}}
+)
+
 type Endpoints struct {
-	Create Controller
-	Get    Controller
-	GetAll Controller
-	Update Controller
-	Delete Controller
+	Create      Controller
+	Get         Controller
+	GetAll      Controller
+	Update      Controller
+	UpdateBatch Controller
+	Delete      Controller
+	Trash       Controller
+	Restore     Controller
+	Purge       Controller
 }
 
 type CreateRequest struct {
@@ -31,6 +66,21 @@ type UpdateRequest struct {
 	EndDate   *string `json:"end_date"`
 }
 
+// BatchUpdateItem is an UpdateRequest for the course id, version replaces
+// the If-Match header.
+type BatchUpdateItem struct {
+	ID      string `json:"id"`
+	Version *int   `json:"version"`
+	UpdateRequest
+}
+
+// BatchUpdateRequest updates several courses, mode is "atomic" (default) or
+// "partial".
+type BatchUpdateRequest struct {
+	Mode  string            `json:"mode"`
+	Items []BatchUpdateItem `json:"items"`
+}
+
 type Response struct {
 	Status int        `json:"status"`
 	Data   any        `json:"data,omitempty"`
@@ -40,11 +90,15 @@ type Response struct {
 
 func MakeEndpoints(s Service) Endpoints {
 	return Endpoints{
-		Create: makeCreateEndpoint(s),
-		Get:    makeGetEndpoint(s),
-		GetAll: makeGetAllEndpoint(s),
-		Update: makeUpdateEndpoint(s),
-		Delete: makeDeleteEndpoint(s),
+		Create:      makeCreateEndpoint(s),
+		Get:         makeGetEndpoint(s),
+		GetAll:      makeGetAllEndpoint(s),
+		Update:      makeUpdateEndpoint(s),
+		UpdateBatch: makeUpdateBatchEndpoint(s),
+		Delete:      makeDeleteEndpoint(s),
+		Trash:       makeTrashEndpoint(s),
+		Restore:     makeRestoreEndpoint(s),
+		Purge:       makePurgeEndpoint(s),
 	}
 }
 
@@ -52,9 +106,9 @@ func makeCreateEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var createRequest CreateRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&createRequest); err != nil {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "invalid request format"})
+		if err := body.Decode(r, &createRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
 			return
 		}
 
@@ -76,7 +130,7 @@ func makeCreateEndpoint(s Service) Controller {
 			return
 		}
 
-		course, err := s.Create(
+		course, err := s.WithContext(r.Context()).Create(
 			createRequest.Name,
 			createRequest.StartDate,
 			createRequest.EndDate,
@@ -96,6 +150,14 @@ func makeGetEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := mux.Vars(r)
 		id := path["id"]
+		selected, err := fields.Parse(r.URL.Query().Get("fields"), selectable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
 		course, err := s.Get(id)
 
 		if err != nil {
@@ -104,7 +166,19 @@ func makeGetEndpoint(s Service) Controller {
 			return
 		}
 
-		json.NewEncoder(w).Encode(Response{Status: 200, Data: course})
+		if httpcache.Validate(w, r, etag.Version(course.Version), course.UpdatedAt) {
+			return
+		}
+
+		data, err := fields.Select(course, selected)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: data})
 	}
 }
 
@@ -117,17 +191,75 @@ func makeGetAllEndpoint(s Service) Controller {
 			EndDate:   query.Get("end_date"),
 		}
 
-		count, err := s.Count(filters)
+		if err := listing.ParseTimeFilters(query, &filters.UpdatedSince, &filters.CreatedBefore); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		conditions, err := filter.Parse(query, filterable)
 
 		if err != nil {
-			w.WriteHeader(500)
-			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
 			return
 		}
 
-		limit, _ := strconv.Atoi(query.Get("limit"))
-		page, _ := strconv.Atoi(query.Get("page"))
-		meta, err := meta.New(page, limit, count)
+		filters.Conditions = conditions
+
+		selected, err := fields.Parse(query.Get("fields"), selectable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		filters.Search = query.Get("q")
+
+		// searches are ranked by relevance unless a sort is given.
+		fallback := defaultSort
+		if filters.Search != "" {
+			fallback = nil
+		}
+
+		sort, err := listing.ParseSort(query.Get("sort"), sortable, fallback)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if format, ok := export.Negotiate(w, r); ok {
+			limit, err := export.Limit(w, func() (int, error) { return s.Count(filters) })
+
+			if err != nil {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+				return
+			}
+
+			opts := listing.Options{Sort: sort, Limit: limit}
+
+			err = export.Stream(w, format, "courses", fields.Columns(selected, selectable), func(write func(row any) error) error {
+				return s.Each(filters, opts, func(course domain.Course) error { return write(course) })
+			})
+
+			if err != nil && !errors.Is(err, export.ErrTruncated) {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			}
+			return
+		}
+
+		meta, opts, err := listing.New(query, sort, func() (int, error) { return s.Count(filters) })
+
+		if errors.Is(err, listing.ErrInvalidCursor) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
 
 		if err != nil {
 			w.WriteHeader(500)
@@ -135,7 +267,11 @@ func makeGetAllEndpoint(s Service) Controller {
 			return
 		}
 
-		courses, err := s.GetAll(filters, meta.Offset(), meta.Limit())
+		courses, err := s.GetAll(filters, opts)
+
+		if err == nil {
+			courses, err = listing.Page(courses, opts, meta)
+		}
 
 		if err != nil {
 			w.WriteHeader(400)
@@ -143,9 +279,34 @@ func makeGetAllEndpoint(s Service) Controller {
 			return
 		}
 
+		tag := []string{r.URL.RawQuery}
+		if meta.TotalCount != nil {
+			tag = append(tag, strconv.Itoa(*meta.TotalCount))
+		}
+
+		for _, course := range courses {
+			tag = append(tag, course.ID, strconv.Itoa(course.Version))
+		}
+
+		// rows deleted or leaving the page change no updated_at, lists have no
+		// Last-Modified and are only validated by their tag.
+		if httpcache.Validate(w, r, httpcache.Tag(tag...), nil) {
+			return
+		}
+
+		data, err := fields.Select(courses, selected)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		listing.Link(w, r, meta)
+
 		json.NewEncoder(w).Encode(Response{
 			Status: 200,
-			Data:   courses,
+			Data:   data,
 			Meta:   meta,
 		})
 	}
@@ -155,40 +316,43 @@ func makeUpdateEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var updateRequest UpdateRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&updateRequest); err != nil {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "invalid request format"})
+		if err := body.Decode(r, &updateRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
 			return
 		}
 
-		if updateRequest.Name != nil && *updateRequest.Name == "" {
+		if err := updateRequest.validate(); err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "name is required"})
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
 			return
 		}
 
-		if updateRequest.StartDate != nil && *updateRequest.StartDate == "" {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "start date is required"})
-			return
-		}
+		version, err := etag.IfMatch(r)
 
-		if updateRequest.EndDate != nil && *updateRequest.EndDate == "" {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "end date is required"})
+		if err != nil {
+			w.WriteHeader(etag.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: etag.Status(err), Err: err.Error()})
 			return
 		}
 
 		path := mux.Vars(r)
 		id := path["id"]
 
-		err := s.Update(
+		err = s.WithContext(r.Context()).Update(
 			id,
+			version,
 			updateRequest.Name,
 			updateRequest.StartDate,
 			updateRequest.EndDate,
 		)
 
+		if errors.Is(err, ErrVersionConflict) {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(Response{Status: 412, Err: err.Error()})
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(404)
 			json.NewEncoder(w).Encode(Response{Status: 404, Err: "course does not exist"})
@@ -199,11 +363,93 @@ func makeUpdateEndpoint(s Service) Controller {
 	}
 }
 
+func makeUpdateBatchEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var batchRequest BatchUpdateRequest
+
+		if err := body.Decode(r, &batchRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		mode, err := batch.ParseMode(batchRequest.Mode)
+
+		if err == nil {
+			err = batch.Check(len(batchRequest.Items))
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		results, err := s.WithContext(r.Context()).Batch(mode, len(batchRequest.Items), func(s Service, i int) (string, any, error) {
+			item := batchRequest.Items[i]
+
+			if item.ID == "" {
+				return "", nil, errors.New("id is required")
+			}
+
+			if err := item.validate(); err != nil {
+				return item.ID, nil, err
+			}
+
+			if err := etag.Require(item.Version); err != nil {
+				return item.ID, nil, err
+			}
+
+			if err := s.Update(item.ID, item.Version, item.Name, item.StartDate, item.EndDate); err != nil {
+				return item.ID, nil, err
+			}
+
+			course, err := s.Get(item.ID)
+
+			if err != nil {
+				return item.ID, nil, err
+			}
+
+			return course.ID, course, nil
+		}, updateStatus)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		status := batch.Status(mode, results)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{Status: status, Data: results})
+	}
+}
+
 func makeDeleteEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
+		version, err := etag.IfMatch(r)
+
+		if err != nil {
+			w.WriteHeader(etag.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: etag.Status(err), Err: err.Error()})
+			return
+		}
+
 		path := mux.Vars(r)
 		id := path["id"]
-		err := s.Delete(id)
+		result, err := s.WithContext(r.Context()).Delete(id, version)
+
+		if errors.Is(err, ErrVersionConflict) {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(Response{Status: 412, Err: err.Error()})
+			return
+		}
+
+		if errors.Is(err, ErrActiveEnrollments) {
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(Response{Status: 409, Err: err.Error()})
+			return
+		}
 
 		if err != nil {
 			w.WriteHeader(404)
@@ -211,6 +457,102 @@ func makeDeleteEndpoint(s Service) Controller {
 			return
 		}
 
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: result})
+	}
+}
+
+func makeTrashEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		count, err := s.CountDeleted()
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page, _ := strconv.Atoi(query.Get("page"))
+		meta, err := meta.New(page, limit, count)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		courses, err := s.GetDeleted(meta.Offset(), meta.Limit())
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		listing.Link(w, r, meta)
+
+		json.NewEncoder(w).Encode(Response{
+			Status: 200,
+			Data:   courses,
+			Meta:   meta,
+		})
+	}
+}
+
+func makeRestoreEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+
+		if err := s.WithContext(r.Context()).Restore(id); err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "course is not in the trash"})
+			return
+		}
+
 		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
 	}
 }
+
+func makePurgeEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+
+		if err := s.WithContext(r.Context()).Purge(id); err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "course is not in the trash"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func (r UpdateRequest) validate() error {
+	switch {
+	case r.Name != nil && *r.Name == "":
+		return errors.New("name is required")
+	case r.StartDate != nil && *r.StartDate == "":
+		return errors.New("start date is required")
+	case r.EndDate != nil && *r.EndDate == "":
+		return errors.New("end date is required")
+	}
+	return nil
+}
+
+// updateStatus maps the errors of a batch item to the codes of
+// PATCH /courses/{id}.
+func updateStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrVersionConflict):
+		return 412
+	case errors.Is(err, etag.ErrPreconditionRequired):
+		return 428
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return 404
+	default:
+		return 400
+	}
+}
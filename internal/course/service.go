@@ -1,30 +1,65 @@
 package course
 
 import (
+	"context"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/audit"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/batch"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
+	"gorm.io/gorm"
 )
 
 type Service interface {
 	Create(name, startDate, endDate string) (*domain.Course, error)
-	GetAll(filters Filters, offset, limit int) ([]domain.Course, error)
+	GetAll(filters Filters, opts listing.Options) ([]domain.Course, error)
+	// Each streams the courses matching the filters to fn, for exports.
+	Each(filters Filters, opts listing.Options, fn func(course domain.Course) error) error
 	Get(id string) (*domain.Course, error)
-	Delete(id string) error
-	Update(id string, name, startDate, endDate *string) error
+	GetForUpdate(id string) (*domain.Course, error)
+	Delete(id string, version *int) (*domain.DeleteResult, error)
+	Update(id string, version *int, name, startDate, endDate *string) error
 	Count(filters Filters) (int, error)
+	GetDeleted(offset, limit int) ([]domain.Course, error)
+	CountDeleted() (int, error)
+	Restore(id string) error
+	Purge(id string) error
+	PurgeExpired(retention time.Duration) (int, error)
+	// Batch runs fn for n items in one transaction, fn gets the service
+	// bound to the savepoint of its item, see batch.Run.
+	Batch(mode batch.Mode, n int, fn func(s Service, i int) (string, any, error), status func(error) int) ([]batch.Result, error)
+	WithTx(tx *gorm.DB) Service
+	WithContext(ctx context.Context) Service
 }
 
 type service struct {
-	logger     *log.Logger
-	repository Repository
+	logger       *log.Logger
+	repository   Repository
+	deletePolicy domain.DeletePolicy
+	uow          uow.UnitOfWork
+	audit        audit.Recorder
 }
 
+var (
+	ErrActiveEnrollments = errors.New("course has active enrollments")
+	ErrVersionConflict   = errors.New("course was modified by another request")
+)
+
 type Filters struct {
-	Name      string
-	StartDate string
-	EndDate   string
+	Name          string
+	StartDate     string
+	EndDate       string
+	UpdatedSince  *time.Time
+	CreatedBefore *time.Time
+	// Search keeps the rows matching a full text query.
+	Search string
+	// Conditions come from the filter[field][operator] parameters.
+	Conditions []filter.Condition
 }
 
 func (s service) Create(name, startDate, endDate string) (*domain.Course, error) {
@@ -49,15 +84,25 @@ func (s service) Create(name, startDate, endDate string) (*domain.Course, error)
 		EndDate:   endDateParsed,
 	}
 
-	if err := s.repository.Create(course); err != nil {
+	err = s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+
+		if err := s.repository.Create(course); err != nil {
+			return err
+		}
+
+		return s.audit.Record("course", course.ID, audit.ActionCreate, nil, course)
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
 	return course, nil
 }
 
-func (s service) GetAll(filters Filters, offset, limit int) ([]domain.Course, error) {
-	courses, err := s.repository.GetAll(filters, offset, limit)
+func (s service) GetAll(filters Filters, opts listing.Options) ([]domain.Course, error) {
+	courses, err := s.repository.GetAll(filters, opts)
 
 	if err != nil {
 		return nil, err
@@ -66,6 +111,10 @@ func (s service) GetAll(filters Filters, offset, limit int) ([]domain.Course, er
 	return courses, nil
 }
 
+func (s service) Each(filters Filters, opts listing.Options, fn func(course domain.Course) error) error {
+	return s.repository.Each(filters, opts, fn)
+}
+
 func (s service) Get(id string) (*domain.Course, error) {
 	course, err := s.repository.Get(id)
 
@@ -76,11 +125,63 @@ func (s service) Get(id string) (*domain.Course, error) {
 	return course, nil
 }
 
-func (s service) Delete(id string) error {
-	return s.repository.Delete(id)
+func (s service) GetForUpdate(id string) (*domain.Course, error) {
+	return s.repository.GetForUpdate(id)
 }
 
-func (s service) Update(id string, name, startDate, endDate *string) error {
+func (s service) Delete(id string, version *int) (*domain.DeleteResult, error) {
+	var affected int
+
+	err := s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+		before, err := s.repository.GetForUpdate(id)
+
+		if err != nil {
+			return err
+		}
+
+		enrollments, cancelled, err := s.repository.Delete(id, version, s.deletePolicy)
+
+		if err != nil {
+			return err
+		}
+
+		affected = len(enrollments)
+
+		if err := s.audit.Record("course", id, audit.ActionDelete, before, nil); err != nil {
+			return err
+		}
+
+		return s.auditEnrollments(enrollments, cancelled)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.DeleteResult{Policy: s.deletePolicy, Enrollments: affected}, nil
+}
+
+// auditEnrollments records what the delete policy did to the enrollments,
+// the ones missing from after were deleted.
+func (s service) auditEnrollments(before, after []domain.Enrollment) error {
+	for i := range before {
+		var err error
+
+		if i < len(after) {
+			err = s.audit.Record("enrollment", before[i].ID, audit.ActionUpdate, &before[i], &after[i])
+		} else {
+			err = s.audit.Record("enrollment", before[i].ID, audit.ActionDelete, &before[i], nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s service) Update(id string, version *int, name, startDate, endDate *string) error {
 	var startDateParsed, endDateParsed *time.Time
 
 	if startDate != nil {
@@ -105,13 +206,149 @@ func (s service) Update(id string, name, startDate, endDate *string) error {
 		endDateParsed = &date
 	}
 
-	return s.repository.Update(id, name, startDateParsed, endDateParsed)
+	return s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+		before, err := s.repository.GetForUpdate(id)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s.repository.Update(id, version, name, startDateParsed, endDateParsed); err != nil {
+			return err
+		}
+
+		after, err := s.repository.Get(id)
+
+		if err != nil {
+			return err
+		}
+
+		return s.audit.Record("course", id, audit.ActionUpdate, before, after)
+	})
 }
 
 func (s service) Count(filters Filters) (int, error) {
 	return s.repository.Count(filters)
 }
 
-func NewService(repository Repository, logger *log.Logger) Service {
-	return &service{logger: logger, repository: repository}
+func (s service) GetDeleted(offset, limit int) ([]domain.Course, error) {
+	return s.repository.GetDeleted(offset, limit)
+}
+
+func (s service) CountDeleted() (int, error) {
+	return s.repository.CountDeleted()
+}
+
+func (s service) Restore(id string) error {
+	return s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+
+		if err := s.repository.Restore(id); err != nil {
+			return err
+		}
+
+		after, err := s.repository.Get(id)
+
+		if err != nil {
+			return err
+		}
+
+		return s.audit.Record("course", id, audit.ActionRestore, nil, after)
+	})
+}
+
+func (s service) Purge(id string) error {
+	return s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+		enrollments, err := s.repository.Purge(id)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s.audit.Record("course", id, audit.ActionPurge, nil, nil); err != nil {
+			return err
+		}
+
+		// the audit log keeps the history of the enrollments removed.
+		for i := range enrollments {
+			if err := s.audit.Record("enrollment", enrollments[i].ID, audit.ActionPurge, &enrollments[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeExpired permanently removes the courses deleted more than retention
+// ago, one at a time like Purge so each one is audited.
+func (s service) PurgeExpired(retention time.Duration) (int, error) {
+	ids, err := s.repository.GetDeletedBefore(time.Now().Add(-retention))
+
+	if err != nil {
+		s.logger.Println(err)
+		return 0, err
+	}
+
+	purged := 0
+
+	for _, id := range ids {
+		// restored meanwhile
+		if err := s.Purge(id); errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			s.logger.Println(err)
+			return purged, err
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		s.logger.Printf("%d courses purged from trash", purged)
+	}
+	return purged, nil
+}
+
+func (s service) Batch(mode batch.Mode, n int, fn func(s Service, i int) (string, any, error), status func(error) int) ([]batch.Result, error) {
+	return batch.Run(s.uow, mode, n, func(tx *gorm.DB, i int) (string, any, error) {
+		return fn(s.WithTx(tx), i)
+	}, status)
+}
+
+// WithTx returns a copy of the service whose repository runs inside tx,
+// its own units of work nest in it.
+func (s service) WithTx(tx *gorm.DB) Service {
+	s = s.withTx(tx)
+	return &s
+}
+
+func (s service) withTx(tx *gorm.DB) service {
+	s.repository = s.repository.WithTx(tx)
+	s.audit = s.audit.WithTx(tx)
+	s.uow = uow.New(tx)
+	return s
+}
+
+// WithContext returns a copy of the service bound to the request context.
+func (s service) WithContext(ctx context.Context) Service {
+	s.repository = s.repository.WithContext(ctx)
+	s.audit = s.audit.WithContext(ctx)
+	return &s
+}
+
+func NewService(
+	repository Repository,
+	logger *log.Logger,
+	deletePolicy domain.DeletePolicy,
+	unitOfWork uow.UnitOfWork,
+	recorder audit.Recorder,
+) Service {
+	return &service{
+		logger:       logger,
+		repository:   repository,
+		deletePolicy: deletePolicy,
+		uow:          unitOfWork,
+		audit:        recorder,
+	}
 }
@@ -0,0 +1,30 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"gorm.io/gorm"
+)
+
+// actor returns the id of the principal authenticated in the context of the
+// statement, empty for anonymous requests or background jobs.
+func actor(tx *gorm.DB) string {
+	if p := auth.FromContext(tx.Statement.Context); p != nil {
+		return p.ID
+	}
+	return ""
+}
+
+// setUpdatedBy also works for updates made with a map of values.
+func setUpdatedBy(tx *gorm.DB) {
+	if id := actor(tx); id != "" {
+		tx.Statement.SetColumn("updated_by", id)
+	}
+}
+
+// SoftDelete trashes the rows of model matched by tx, like Delete does but
+// through an update, so the hooks record who deleted them in updated_by.
+func SoftDelete(tx *gorm.DB, model any) *gorm.DB {
+	return tx.Model(model).Updates(map[string]any{"deleted": time.Now(), "version": gorm.Expr("version + 1")})
+}
@@ -0,0 +1,61 @@
+package domain
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type APIKey struct {
+	ID         string     `json:"id" gorm:"type:char(36);not null;primary_key;unique_index"`
+	Name       string     `json:"name" gorm:"type:char(50);not null"`
+	Prefix     string     `json:"prefix" gorm:"type:char(11);not null"`
+	Hash       string     `json:"-" gorm:"type:char(64);not null;uniqueIndex"`
+	Scopes     Scopes     `json:"scopes" gorm:"type:varchar(255);not null"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  *time.Time `json:"-"`
+	UpdatedAt  *time.Time `json:"-"`
+}
+
+func (k *APIKey) BeforeCreate(tx *gorm.DB) error {
+	if k.ID == "" {
+		k.ID = uuid.NewString()
+	}
+	return nil
+}
+
+// Scopes is stored as a comma separated list and exposed as a JSON array.
+type Scopes []string
+
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, ","), nil
+}
+
+func (s *Scopes) Scan(value any) error {
+	var raw string
+
+	switch v := value.(type) {
+	case []byte:
+		raw = string(v)
+	case string:
+		raw = v
+	case nil:
+		*s = nil
+		return nil
+	default:
+		return fmt.Errorf("unsupported scopes value %T", value)
+	}
+
+	*s = nil
+	for _, scope := range strings.Split(raw, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			*s = append(*s, scope)
+		}
+	}
+	return nil
+}
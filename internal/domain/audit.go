@@ -0,0 +1,20 @@
+package domain
+
+import "time"
+
+// AuditLog is an append-only record of a mutation.
+type AuditLog struct {
+	ID        uint64                 `json:"id" gorm:"primaryKey;autoIncrement"`
+	Actor     string                 `json:"actor" gorm:"type:varchar(64)"`
+	RequestID string                 `json:"request_id" gorm:"type:varchar(64)"`
+	Entity    string                 `json:"entity" gorm:"type:char(20);not null;index:idx_audit_entity"`
+	EntityID  string                 `json:"entity_id" gorm:"type:char(36);not null;index:idx_audit_entity"`
+	Action    string                 `json:"action" gorm:"type:char(10);not null"`
+	Changes   map[string]FieldChange `json:"changes" gorm:"type:text;serializer:json"`
+	CreatedAt *time.Time             `json:"created_at"`
+}
+
+type FieldChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
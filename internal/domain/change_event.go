@@ -0,0 +1,44 @@
+package domain
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// ChangeEvent is a row of the outbox read by the change feed. Events are
+// written in the transaction of the mutation, hard deletes included, and
+// get their Seq once committed, so the feed follows the commit order.
+type ChangeEvent struct {
+	ID        uint64          `gorm:"primaryKey;autoIncrement"`
+	Seq       *uint64         `gorm:"uniqueIndex"`
+	Entity    string          `gorm:"type:char(20);not null"`
+	EntityID  string          `gorm:"type:char(36);not null"`
+	Action    string          `gorm:"type:char(10);not null"`
+	Data      json.RawMessage `gorm:"type:mediumtext"`
+	ChangedAt time.Time       `gorm:"not null;index"`
+}
+
+// NewChangeEvent keeps the JSON representation of data, the state of the
+// row after the change; nil for rows removed for good.
+func NewChangeEvent(entity, id, action string, data any) (*ChangeEvent, error) {
+	event := &ChangeEvent{Entity: entity, EntityID: id, Action: action, ChangedAt: time.Now()}
+
+	if data == nil {
+		return event, nil
+	}
+
+	raw, err := json.Marshal(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	event.Data = raw
+	return event, nil
+}
@@ -3,6 +3,7 @@ package domain
 import (
 	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fulltext"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
@@ -12,14 +13,30 @@ type Course struct {
 	Name      string         `json:"name" gorm:"type:char(50);not null"`
 	StartDate time.Time      `json:"start_date"`
 	EndDate   time.Time      `json:"end_date"`
-	CreatedAt *time.Time     `json:"-"`
-	UpdatedAt *time.Time     `json:"-"`
+	Version   int            `json:"version" gorm:"not null;default:1"`
+	CreatedAt *time.Time     `json:"created_at"`
+	UpdatedAt *time.Time     `json:"updated_at"`
+	CreatedBy string         `json:"created_by" gorm:"type:varchar(64)"`
+	UpdatedBy string         `json:"updated_by" gorm:"type:varchar(64)"`
 	Deleted   gorm.DeletedAt `json:"-"`
 }
 
+// CourseSearch is the full text index of courses.
+var CourseSearch = fulltext.Index{Table: "courses", Columns: []string{"name"}}
+
 func (c *Course) BeforeCreate(tx *gorm.DB) error {
 	if c.ID == "" {
 		c.ID = uuid.NewString()
 	}
+	if c.Version == 0 {
+		c.Version = 1
+	}
+	c.CreatedBy = actor(tx)
+	c.UpdatedBy = c.CreatedBy
+	return nil
+}
+
+func (c *Course) BeforeUpdate(tx *gorm.DB) error {
+	setUpdatedBy(tx)
 	return nil
 }
@@ -1,6 +1,7 @@
 package domain
 
 import (
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,19 +9,72 @@ import (
 )
 
 type Enrollment struct {
-	ID        string     `json:"id" gorm:"type:char(36);not null;primary_key:unique_index"`
-	UserID    string     `json:"user_id,omitempty" gorm:"type:char(36)"`
-	User      *User      `json:"user,omitempty"`
-	CourseID  string     `json:"course_id" gorm:"type:char(36):not null"`
-	Course    *Course    `json:"course,omitempty"`
-	Status    string     `json:"status" gorm:"type:char(2)"`
-	CreatedAt *time.Time `json:"-"`
-	UpdatedAt *time.Time `json:"-"`
+	ID        string         `json:"id" gorm:"type:char(36);not null;primary_key;unique_index"`
+	UserID    string         `json:"user_id,omitempty" gorm:"type:char(36);not null;index"`
+	User      *User          `json:"user,omitempty" gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT"`
+	CourseID  string         `json:"course_id" gorm:"type:char(36);not null;index"`
+	Course    *Course        `json:"course,omitempty" gorm:"constraint:OnUpdate:CASCADE,OnDelete:RESTRICT"`
+	Status    string         `json:"status" gorm:"type:char(2);not null"`
+	Version   int            `json:"version" gorm:"not null;default:1"`
+	CreatedAt *time.Time     `json:"created_at"`
+	UpdatedAt *time.Time     `json:"updated_at"`
+	CreatedBy string         `json:"created_by" gorm:"type:varchar(64)"`
+	UpdatedBy string         `json:"updated_by" gorm:"type:varchar(64)"`
+	Deleted   gorm.DeletedAt `json:"-"`
+}
+
+const (
+	EnrollmentPending   = "P"
+	EnrollmentCancelled = "C"
+)
+
+// DeletePolicy decides what happens to the enrollments of a user or a course
+// being deleted.
+type DeletePolicy string
+
+const (
+	// DeleteBlock refuses to delete while there are active enrollments.
+	DeleteBlock DeletePolicy = "block"
+	// DeleteCancel cancels the active enrollments.
+	DeleteCancel DeletePolicy = "cancel"
+	// DeleteCascade soft deletes every enrollment.
+	DeleteCascade DeletePolicy = "delete"
+)
+
+var ErrUnknownDeletePolicy = errors.New(`unknown delete policy, use "block", "cancel" or "delete"`)
+
+// ParseDeletePolicy defaults to DeleteBlock when policy is empty, an unknown
+// policy is an error so a typo can not silently change what deletes do.
+func ParseDeletePolicy(policy string) (DeletePolicy, error) {
+	switch p := DeletePolicy(policy); p {
+	case "":
+		return DeleteBlock, nil
+	case DeleteBlock, DeleteCancel, DeleteCascade:
+		return p, nil
+	default:
+		return "", ErrUnknownDeletePolicy
+	}
+}
+
+// DeleteResult reports what a delete did to the related enrollments.
+type DeleteResult struct {
+	Policy      DeletePolicy `json:"policy"`
+	Enrollments int          `json:"enrollments"`
 }
 
 func (u *Enrollment) BeforeCreate(tx *gorm.DB) error {
 	if u.ID == "" {
 		u.ID = uuid.NewString()
 	}
+	if u.Version == 0 {
+		u.Version = 1
+	}
+	u.CreatedBy = actor(tx)
+	u.UpdatedBy = u.CreatedBy
+	return nil
+}
+
+func (u *Enrollment) BeforeUpdate(tx *gorm.DB) error {
+	setUpdatedBy(tx)
 	return nil
 }
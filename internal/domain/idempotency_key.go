@@ -0,0 +1,22 @@
+package domain
+
+import "time"
+
+// IdempotencyKey is the first response to a request sent with an
+// Idempotency-Key header, replayed when the request is retried. Its ID is a
+// hash of the key and the principal that sent it. StartedAt is the lease of
+// the request handling it while pending, a stale lease is reclaimed.
+type IdempotencyKey struct {
+	ID          string     `gorm:"type:char(64);not null;primary_key"`
+	Fingerprint string     `gorm:"type:char(64);not null"`
+	Status      int        `gorm:"not null;default:0"`
+	Header      string     `gorm:"type:text"`
+	Body        []byte     `gorm:"type:mediumblob"`
+	StartedAt   time.Time  `gorm:"type:datetime(3)"`
+	CreatedAt   *time.Time `gorm:"index"`
+}
+
+// Pending reports whether the first request is still being handled.
+func (k IdempotencyKey) Pending() bool {
+	return k.Status == 0
+}
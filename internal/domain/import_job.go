@@ -0,0 +1,48 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ImportRunning   = "running"
+	ImportCompleted = "completed"
+	ImportFailed    = "failed"
+)
+
+// ImportJob tracks the import of a CSV file, the rows that could not be
+// imported are kept as ImportError.
+type ImportJob struct {
+	ID           string     `json:"id" gorm:"type:char(36);not null;primary_key;unique_index"`
+	Kind         string     `json:"kind" gorm:"type:char(20);not null"`
+	Status       string     `json:"status" gorm:"type:char(10);not null"`
+	DryRun       bool       `json:"dry_run"`
+	TotalRows    int        `json:"total_rows"`
+	ImportedRows int        `json:"imported_rows"`
+	FailedRows   int        `json:"failed_rows"`
+	Error        string     `json:"error,omitempty" gorm:"type:text"`
+	CreatedBy    string     `json:"created_by" gorm:"type:varchar(64)"`
+	CreatedAt    *time.Time `json:"created_at"`
+	UpdatedAt    *time.Time `json:"updated_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+}
+
+// ImportError is a row of an import that failed, Row is its line number in
+// the file (the header is line 1).
+type ImportError struct {
+	ID      uint64 `json:"-" gorm:"primaryKey;autoIncrement"`
+	JobID   string `json:"job_id" gorm:"type:char(36);not null;index"`
+	Row     int    `json:"row"`
+	Message string `json:"error" gorm:"type:text"`
+}
+
+func (j *ImportJob) BeforeCreate(tx *gorm.DB) error {
+	if j.ID == "" {
+		j.ID = uuid.NewString()
+	}
+	j.CreatedBy = actor(tx)
+	return nil
+}
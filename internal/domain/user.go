@@ -1,26 +1,58 @@
 package domain
 
 import (
+	"strings"
 	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fulltext"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type User struct {
-	ID        string         `json:"id" gorm:"type:char(36);not null;primary_key;unique_index"`
-	FirstName string         `json:"first_name" gorm:"type:char(50);not null"`
-	LastName  string         `json:"last_name" gorm:"type:char(50);not null"`
-	Email     string         `json:"email" gorm:"type:char(50);not null"`
-	Phone     string         `json:"phone" gorm:"type:char(30);not null"`
-	CreatedAt *time.Time     `json:"-"`
-	UpdatedAt *time.Time     `json:"-"`
-	Deleted   gorm.DeletedAt `json:"-"`
+	ID              string         `json:"id" gorm:"type:char(36);not null;primary_key;unique_index"`
+	FirstName       string         `json:"first_name" gorm:"type:char(50);not null"`
+	LastName        string         `json:"last_name" gorm:"type:char(50);not null"`
+	Email           string         `json:"email" gorm:"type:char(50);not null;uniqueIndex"`
+	Phone           string         `json:"phone" gorm:"type:char(30);not null;index"`
+	PhoneDisplay    string         `json:"phone_display" gorm:"type:char(30);not null"`
+	PasswordHash    string         `json:"-" gorm:"type:varchar(255)"`
+	EmailVerifiedAt *time.Time     `json:"email_verified_at"`
+	Version         int            `json:"version" gorm:"not null;default:1"`
+	CreatedAt       *time.Time     `json:"created_at"`
+	UpdatedAt       *time.Time     `json:"updated_at"`
+	CreatedBy       string         `json:"created_by" gorm:"type:varchar(64)"`
+	UpdatedBy       string         `json:"updated_by" gorm:"type:varchar(64)"`
+	Deleted         gorm.DeletedAt `json:"-"`
+}
+
+// UserSearch is the full text index of users.
+var UserSearch = fulltext.Index{Table: "users", Columns: []string{"first_name", "last_name", "email"}}
+
+// CanonicalEmail trims the address and lowercases its domain, the local part
+// is case sensitive.
+func CanonicalEmail(email string) string {
+	email = strings.TrimSpace(email)
+
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		return email[:at] + "@" + strings.ToLower(email[at+1:])
+	}
+	return email
 }
 
 func (u *User) BeforeCreate(tx *gorm.DB) error {
 	if u.ID == "" {
 		u.ID = uuid.NewString()
 	}
+	if u.Version == 0 {
+		u.Version = 1
+	}
+	u.CreatedBy = actor(tx)
+	u.UpdatedBy = u.CreatedBy
+	return nil
+}
+
+func (u *User) BeforeUpdate(tx *gorm.DB) error {
+	setUpdatedBy(tx)
 	return nil
 }
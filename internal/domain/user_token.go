@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+	TokenSession       = "session"
+)
+
+// UserToken is a single use token sent by mail, or the session token issued
+// by a login until it is used to log out. Only its hash is stored.
+type UserToken struct {
+	ID        string     `json:"id" gorm:"type:char(36);not null;primary_key;unique_index"`
+	UserID    string     `json:"user_id" gorm:"type:char(36);not null;index"`
+	Purpose   string     `json:"purpose" gorm:"type:char(20);not null"`
+	Hash      string     `json:"-" gorm:"type:char(64);not null;uniqueIndex"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt *time.Time `json:"-"`
+}
+
+func (t *UserToken) BeforeCreate(tx *gorm.DB) error {
+	if t.ID == "" {
+		t.ID = uuid.NewString()
+	}
+	return nil
+}
@@ -2,15 +2,58 @@ package enrollment
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/batch"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/body"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/etag"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/export"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fields"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/httpcache"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
 	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+	"github.com/gorilla/mux"
 )
 
 type Controller func(w http.ResponseWriter, r *http.Request)
 
+var (
+	// selectable are the fields accepted by the fields parameter.
+	selectable = []string{"id", "user_id", "user", "course_id", "course", "status", "version", "created_at", "updated_at", "created_by", "updated_by"}
+	// includable are the relations accepted by the include parameter.
+	includable = []string{"user", "course"}
+	// relationScopes are the scopes needed to embed each relation, the same
+	// as reading it.
+	relationScopes = map[string]string{"user": "users:read", "course": "courses:read"}
+	// sortable are the fields accepted by the sort parameter of lists.
+	sortable = []string{"user_id", "course_id", "status", "created_at", "updated_at"}
+	// filterable are the fields accepted by the filter parameters of lists.
+	filterable = filter.Schema{
+		"user_id":    {Column: "user_id"},
+		"course_id":  {Column: "course_id"},
+		"status":     {Column: "status"},
+		"version":    {Column: "version", Kind: filter.Int},
+		"created_at": {Column: "created_at", Kind: filter.Time},
+		"updated_at": {Column: "updated_at", Kind: filter.Time},
+		"created_by": {Column: "created_by"},
+		"updated_by": {Column: "updated_by"},
+	}
+	// defaultSort lists the newest first.
+	defaultSort = []listing.Order{{Column: "created_at", Desc: true}}
+)
+
 type Endpoints struct {
-	Create Controller
+	Create      Controller
+	CreateBatch Controller
+	Get         Controller
+	GetAll      Controller
+	Update      Controller
 }
 
 type CreateRequest struct {
@@ -18,6 +61,17 @@ type CreateRequest struct {
 	CourseID string `json:"course_id"`
 }
 
+// BatchCreateRequest creates several enrollments, mode is "atomic" (default)
+// or "partial".
+type BatchCreateRequest struct {
+	Mode  string          `json:"mode"`
+	Items []CreateRequest `json:"items"`
+}
+
+type UpdateRequest struct {
+	Status *string `json:"status"`
+}
+
 type Response struct {
 	Status int        `json:"status"`
 	Data   any        `json:"data,omitempty"`
@@ -27,7 +81,11 @@ type Response struct {
 
 func MakeEndpoints(s Service) Endpoints {
 	return Endpoints{
-		Create: makeCreateEndpoint(s),
+		Create:      makeCreateEndpoint(s),
+		CreateBatch: makeCreateBatchEndpoint(s),
+		Get:         makeGetEndpoint(s),
+		GetAll:      makeGetAllEndpoint(s),
+		Update:      makeUpdateEndpoint(s),
 	}
 }
 
@@ -35,28 +93,88 @@ func makeCreateEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var createRequest CreateRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&createRequest); err != nil {
+		if err := body.Decode(r, &createRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		if err := createRequest.validate(); err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "invalid request format"})
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
 			return
 		}
 
-		if createRequest.UserID == "" {
+		enrollment, err := s.WithContext(r.Context()).Create(
+			createRequest.UserID,
+			createRequest.CourseID,
+		)
+
+		if err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "name is required"})
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: enrollment})
+	}
+}
+
+func makeCreateBatchEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var batchRequest BatchCreateRequest
+
+		if err := body.Decode(r, &batchRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
 			return
 		}
 
-		if createRequest.CourseID == "" {
+		mode, err := batch.ParseMode(batchRequest.Mode)
+
+		if err == nil {
+			err = batch.Check(len(batchRequest.Items))
+		}
+
+		if err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "start date is required"})
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
 			return
 		}
 
-		enrollment, err := s.Create(
-			createRequest.UserID,
-			createRequest.CourseID,
-		)
+		results, err := s.WithContext(r.Context()).Batch(mode, len(batchRequest.Items), func(s Service, i int) (string, any, error) {
+			item := batchRequest.Items[i]
+
+			if err := item.validate(); err != nil {
+				return "", nil, err
+			}
+
+			enrollment, err := s.Create(item.UserID, item.CourseID)
+
+			if err != nil {
+				return "", nil, err
+			}
+
+			return enrollment.ID, enrollment, nil
+		}, createStatus)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		status := batch.Status(mode, results)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{Status: status, Data: results})
+	}
+}
+
+func makeGetEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+		include, err := fields.ParseInclude(r.URL.Query().Get("include"), includable)
 
 		if err != nil {
 			w.WriteHeader(400)
@@ -64,6 +182,291 @@ func makeCreateEndpoint(s Service) Controller {
 			return
 		}
 
-		json.NewEncoder(w).Encode(Response{Status: 200, Data: enrollment})
+		selected, err := fields.Parse(r.URL.Query().Get("fields"), selectable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		include = fields.Implied(include, selected, includable)
+
+		if scope := missingScope(r, include); scope != "" {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: "missing scope " + scope})
+			return
+		}
+
+		enrollment, err := s.Get(id, include...)
+
+		if err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "enrollment does not exist"})
+			return
+		}
+
+		// embedded relations change without bumping the enrollment version.
+		tag := etag.Version(enrollment.Version)
+		if len(include) > 0 {
+			tag = httpcache.Tag(versions(*enrollment)...)
+		}
+
+		if httpcache.Validate(w, r, tag, httpcache.Latest(modified(*enrollment)...)) {
+			return
+		}
+
+		data, err := fields.Select(enrollment, selected)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: data})
+	}
+}
+
+func makeGetAllEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filters := Filters{
+			UserID:   query.Get("user_id"),
+			CourseID: query.Get("course_id"),
+			Status:   query.Get("status"),
+		}
+
+		if err := listing.ParseTimeFilters(query, &filters.UpdatedSince, &filters.CreatedBefore); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		conditions, err := filter.Parse(query, filterable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		filters.Conditions = conditions
+
+		filters.Include, err = fields.ParseInclude(query.Get("include"), includable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		selected, err := fields.Parse(query.Get("fields"), selectable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		filters.Include = fields.Implied(filters.Include, selected, includable)
+
+		if scope := missingScope(r, filters.Include); scope != "" {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: "missing scope " + scope})
+			return
+		}
+
+		sort, err := listing.ParseSort(query.Get("sort"), sortable, defaultSort)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if format, ok := export.Negotiate(w, r); ok {
+			limit, err := export.Limit(w, func() (int, error) { return s.Count(filters) })
+
+			if err != nil {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+				return
+			}
+
+			opts := listing.Options{Sort: sort, Limit: limit}
+
+			err = export.Stream(w, format, "enrollments", fields.Columns(selected, selectable), func(write func(row any) error) error {
+				return s.Each(filters, opts, func(enrollment domain.Enrollment) error { return write(enrollment) })
+			})
+
+			if err != nil && !errors.Is(err, export.ErrTruncated) {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			}
+			return
+		}
+
+		meta, opts, err := listing.New(query, sort, func() (int, error) { return s.Count(filters) })
+
+		if errors.Is(err, listing.ErrInvalidCursor) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		enrollments, err := s.GetAll(filters, opts)
+
+		if err == nil {
+			enrollments, err = listing.Page(enrollments, opts, meta)
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		tag := []string{r.URL.RawQuery}
+		if meta.TotalCount != nil {
+			tag = append(tag, strconv.Itoa(*meta.TotalCount))
+		}
+
+		for _, enrollment := range enrollments {
+			tag = append(tag, versions(enrollment)...)
+		}
+
+		// rows deleted or leaving the page change no updated_at, lists have no
+		// Last-Modified and are only validated by their tag.
+		if httpcache.Validate(w, r, httpcache.Tag(tag...), nil) {
+			return
+		}
+
+		data, err := fields.Select(enrollments, selected)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		listing.Link(w, r, meta)
+
+		json.NewEncoder(w).Encode(Response{
+			Status: 200,
+			Data:   data,
+			Meta:   meta,
+		})
+	}
+}
+
+func makeUpdateEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var updateRequest UpdateRequest
+
+		if err := body.Decode(r, &updateRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		version, err := etag.IfMatch(r)
+
+		if err != nil {
+			w.WriteHeader(etag.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: etag.Status(err), Err: err.Error()})
+			return
+		}
+
+		path := mux.Vars(r)
+		id := path["id"]
+
+		err = s.WithContext(r.Context()).Update(id, version, updateRequest.Status)
+
+		if errors.Is(err, ErrInvalidStatus) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if errors.Is(err, ErrVersionConflict) {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(Response{Status: 412, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "enrollment does not exist"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+// versions identifies an enrollment and the relations embedded in it.
+func versions(enrollment domain.Enrollment) []string {
+	tag := []string{enrollment.ID, strconv.Itoa(enrollment.Version)}
+
+	if enrollment.User != nil {
+		tag = append(tag, enrollment.User.ID, strconv.Itoa(enrollment.User.Version))
+	}
+
+	if enrollment.Course != nil {
+		tag = append(tag, enrollment.Course.ID, strconv.Itoa(enrollment.Course.Version))
+	}
+
+	return tag
+}
+
+// modified are the last modifications of an enrollment and its relations.
+func modified(enrollment domain.Enrollment) []*time.Time {
+	times := []*time.Time{enrollment.UpdatedAt}
+
+	if enrollment.User != nil {
+		times = append(times, enrollment.User.UpdatedAt)
+	}
+
+	if enrollment.Course != nil {
+		times = append(times, enrollment.Course.UpdatedAt)
+	}
+
+	return times
+}
+
+func (r CreateRequest) validate() error {
+	switch {
+	case r.UserID == "":
+		return errors.New("user id is required")
+	case r.CourseID == "":
+		return errors.New("course id is required")
+	}
+	return nil
+}
+
+// createStatus maps the errors of a batch item, a missing user or course is
+// reported as 404.
+func createStatus(err error) int {
+	if errors.Is(err, ErrUserNotFound) || errors.Is(err, ErrCourseNotFound) {
+		return 404
+	}
+	return 400
+}
+
+// missingScope returns the scope of the first included relation the request
+// can not read, empty when it can read them all.
+func missingScope(r *http.Request, include []string) string {
+	for _, relation := range include {
+		if scope := relationScopes[relation]; !auth.Allowed(r.Context(), scope) {
+			return scope
+		}
 	}
+	return ""
 }
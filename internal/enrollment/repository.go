@@ -1,14 +1,50 @@
 package enrollment
 
 import (
+	"context"
 	"log"
+	"slices"
 
 	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/etag"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repository interface {
 	Create(enrollment *domain.Enrollment) error
+	Get(id string, include ...string) (*domain.Enrollment, error)
+	GetForUpdate(id string) (*domain.Enrollment, error)
+	GetAll(filters Filters, opts listing.Options) ([]domain.Enrollment, error)
+	Each(filters Filters, opts listing.Options, fn func(enrollment domain.Enrollment) error) error
+	Count(filters Filters) (int, error)
+	Update(id string, version *int, status *string) error
+	Orphans() ([]Orphan, error)
+	WithTx(tx *gorm.DB) Repository
+	WithContext(ctx context.Context) Repository
+}
+
+// relations maps the include parameter to the relations it preloads, only
+// single rows can be embedded.
+var relations = map[string]string{
+	"user":   "User",
+	"course": "Course",
+}
+
+// eachBatch is the number of streamed enrollments whose relations are
+// loaded at once.
+const eachBatch = 500
+
+// Orphan is an enrollment pointing to a user or course that does not exist,
+// soft deleted rows still count as existing.
+type Orphan struct {
+	EnrollmentID  string `json:"enrollment_id"`
+	UserID        string `json:"user_id"`
+	CourseID      string `json:"course_id"`
+	MissingUser   bool   `json:"missing_user"`
+	MissingCourse bool   `json:"missing_course"`
 }
 
 type repository struct {
@@ -26,6 +62,257 @@ func (r repository) Create(enrollment *domain.Enrollment) error {
 	return nil
 }
 
+func (r repository) Get(id string, include ...string) (*domain.Enrollment, error) {
+	enrollment := domain.Enrollment{ID: id}
+	if err := preload(r.db, include).First(&enrollment).Error; err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+// GetForUpdate locks the row until the end of the transaction, so it can not
+// be updated concurrently.
+func (r repository) GetForUpdate(id string) (*domain.Enrollment, error) {
+	enrollment := domain.Enrollment{ID: id}
+	if err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&enrollment).Error; err != nil {
+		return nil, err
+	}
+	return &enrollment, nil
+}
+
+func (r repository) GetAll(filters Filters, opts listing.Options) ([]domain.Enrollment, error) {
+	var enrollments []domain.Enrollment
+
+	tx := r.db.Model(&enrollments)
+
+	tx = applyFilters(tx, filters)
+	tx = preload(tx, filters.Include)
+
+	tx, err := listing.Apply(tx, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Find(&enrollments).Error; err != nil {
+		return nil, err
+	}
+	return enrollments, nil
+}
+
+// Each streams the enrollments of GetAll to fn with a cursor. Preload does
+// not work with cursors, the included relations are loaded every eachBatch
+// rows instead.
+func (r repository) Each(filters Filters, opts listing.Options, fn func(enrollment domain.Enrollment) error) error {
+	tx, err := listing.Apply(applyFilters(r.db.Model(&domain.Enrollment{}), filters), opts)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	pending := make([]domain.Enrollment, 0, eachBatch)
+
+	flush := func() error {
+		if err := r.attach(pending, filters.Include); err != nil {
+			return err
+		}
+
+		for _, enrollment := range pending {
+			if err := fn(enrollment); err != nil {
+				return err
+			}
+		}
+
+		pending = pending[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		var enrollment domain.Enrollment
+
+		if err := tx.ScanRows(rows, &enrollment); err != nil {
+			return err
+		}
+
+		if pending = append(pending, enrollment); len(pending) == eachBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (r repository) Count(filters Filters) (int, error) {
+	var count int64
+
+	tx := r.db.Model(domain.Enrollment{})
+
+	tx = applyFilters(tx, filters)
+
+	if err := tx.Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (r repository) Update(id string, version *int, status *string) error {
+	values := make(map[string]interface{}, 0)
+
+	if status != nil {
+		values["status"] = *status
+	}
+
+	values["version"] = gorm.Expr("version + 1")
+
+	tx := etag.WhereVersion(r.db.Model(&domain.Enrollment{}).Where("id = ?", id), version)
+
+	if err := tx.Updates(values).Error; err != nil {
+		return err
+	}
+
+	if tx.RowsAffected == 0 {
+		if _, err := r.Get(id); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+func (r repository) Orphans() ([]Orphan, error) {
+	var orphans []Orphan
+
+	err := r.db.Unscoped().
+		Table("enrollments AS e").
+		Select(`e.id AS enrollment_id, e.user_id, e.course_id,
+			u.id IS NULL AS missing_user, c.id IS NULL AS missing_course`).
+		Joins("LEFT JOIN users AS u ON u.id = e.user_id").
+		Joins("LEFT JOIN courses AS c ON c.id = e.course_id").
+		Where("u.id IS NULL OR c.id IS NULL").
+		Order("e.created_at").
+		Scan(&orphans).Error
+
+	if err != nil {
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// WithTx keeps the context of the repository, the transaction may have been
+// started from a db without it.
+func (r repository) WithTx(tx *gorm.DB) Repository {
+	return &repository{logger: r.logger, db: tx.WithContext(r.db.Statement.Context)}
+}
+
+// WithContext makes the context, and the principal it carries, available to
+// the model hooks.
+func (r repository) WithContext(ctx context.Context) Repository {
+	return &repository{logger: r.logger, db: r.db.WithContext(ctx)}
+}
+
 func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
 	return &repository{logger: logger, db: db}
 }
+
+func preload(tx *gorm.DB, include []string) *gorm.DB {
+	for _, name := range include {
+		if relation, ok := relations[name]; ok {
+			tx = tx.Preload(relation)
+		}
+	}
+	return tx
+}
+
+// attach sets the included relations of the enrollments, as Preload does.
+func (r repository) attach(enrollments []domain.Enrollment, include []string) error {
+	if len(enrollments) == 0 {
+		return nil
+	}
+
+	if slices.Contains(include, "user") {
+		users, err := load(r.db, enrollments, func(e domain.Enrollment) string { return e.UserID }, func(u domain.User) string { return u.ID })
+
+		if err != nil {
+			return err
+		}
+
+		for n := range enrollments {
+			enrollments[n].User = users[enrollments[n].UserID]
+		}
+	}
+
+	if slices.Contains(include, "course") {
+		courses, err := load(r.db, enrollments, func(e domain.Enrollment) string { return e.CourseID }, func(c domain.Course) string { return c.ID })
+
+		if err != nil {
+			return err
+		}
+
+		for n := range enrollments {
+			enrollments[n].Course = courses[enrollments[n].CourseID]
+		}
+	}
+
+	return nil
+}
+
+// load finds the rows referenced by the enrollments, indexed by id.
+func load[T any](db *gorm.DB, enrollments []domain.Enrollment, ref func(domain.Enrollment) string, id func(T) string) (map[string]*T, error) {
+	ids := make([]string, 0, len(enrollments))
+
+	for _, enrollment := range enrollments {
+		ids = append(ids, ref(enrollment))
+	}
+
+	var rows []T
+
+	if err := db.Where("id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*T, len(rows))
+
+	for n := range rows {
+		byID[id(rows[n])] = &rows[n]
+	}
+	return byID, nil
+}
+
+func applyFilters(tx *gorm.DB, filters Filters) *gorm.DB {
+	if filters.UserID != "" {
+		tx = tx.Where("user_id = ?", filters.UserID)
+	}
+
+	if filters.CourseID != "" {
+		tx = tx.Where("course_id = ?", filters.CourseID)
+	}
+
+	if filters.Status != "" {
+		tx = tx.Where("status = ?", filters.Status)
+	}
+
+	if filters.UpdatedSince != nil {
+		tx = tx.Where("updated_at >= ?", *filters.UpdatedSince)
+	}
+
+	if filters.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *filters.CreatedBefore)
+	}
+
+	tx = filter.Apply(tx, filters.Conditions)
+
+	return tx
+}
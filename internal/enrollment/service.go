@@ -1,16 +1,47 @@
 package enrollment
 
 import (
+	"context"
 	"errors"
 	"log"
+	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/audit"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/course"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/user"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/batch"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
+	"gorm.io/gorm"
 )
 
 type Service interface {
 	Create(userID, courseID string) (*domain.Enrollment, error)
+	Get(id string, include ...string) (*domain.Enrollment, error)
+	GetAll(filters Filters, opts listing.Options) ([]domain.Enrollment, error)
+	// Each streams the enrollments matching the filters to fn, for exports.
+	Each(filters Filters, opts listing.Options, fn func(enrollment domain.Enrollment) error) error
+	Count(filters Filters) (int, error)
+	Update(id string, version *int, status *string) error
+	// Batch runs fn for n items in one transaction, fn gets the service
+	// bound to the savepoint of its item, see batch.Run.
+	Batch(mode batch.Mode, n int, fn func(s Service, i int) (string, any, error), status func(error) int) ([]batch.Result, error)
+	WithTx(tx *gorm.DB) Service
+	WithContext(ctx context.Context) Service
+}
+
+type Filters struct {
+	UserID        string
+	CourseID      string
+	Status        string
+	UpdatedSince  *time.Time
+	CreatedBefore *time.Time
+	// Include lists the relations to embed, see relations.
+	Include []string
+	// Conditions come from the filter[field][operator] parameters.
+	Conditions []filter.Condition
 }
 
 type service struct {
@@ -18,40 +49,133 @@ type service struct {
 	courseService course.Service
 	logger        *log.Logger
 	repository    Repository
+	uow           uow.UnitOfWork
+	audit         audit.Recorder
 }
 
+var (
+	ErrUserNotFound    = errors.New("user id does not exists")
+	ErrCourseNotFound  = errors.New("course id does not exists")
+	ErrInvalidStatus   = errors.New("invalid status")
+	ErrVersionConflict = errors.New("enrollment was modified by another request")
+)
+
+// Create locks the user and the course until the enrollment is inserted, so
+// neither can be deleted in between.
 func (s service) Create(userID, courseID string) (*domain.Enrollment, error) {
 	enrollment := &domain.Enrollment{
 		UserID:   userID,
 		CourseID: courseID,
-		Status:   "P",
+		Status:   domain.EnrollmentPending,
 	}
 
-	if _, err := s.userService.Get(userID); err != nil {
-		return nil, errors.New("user id does not exists")
-	}
+	err := s.uow.Do(func(tx *gorm.DB) error {
+		if _, err := s.userService.WithTx(tx).GetForUpdate(userID); err != nil {
+			return ErrUserNotFound
+		}
 
-	if _, err := s.courseService.Get(userID); err != nil {
-		return nil, errors.New("course id does not exists")
-	}
+		if _, err := s.courseService.WithTx(tx).GetForUpdate(courseID); err != nil {
+			return ErrCourseNotFound
+		}
+
+		if err := s.repository.WithTx(tx).Create(enrollment); err != nil {
+			return err
+		}
+
+		return s.audit.WithTx(tx).Record("enrollment", enrollment.ID, audit.ActionCreate, nil, enrollment)
+	})
 
-	if err := s.repository.Create(enrollment); err != nil {
+	if err != nil {
 		return nil, err
 	}
 
 	return enrollment, nil
 }
 
+func (s service) Get(id string, include ...string) (*domain.Enrollment, error) {
+	return s.repository.Get(id, include...)
+}
+
+func (s service) GetAll(filters Filters, opts listing.Options) ([]domain.Enrollment, error) {
+	return s.repository.GetAll(filters, opts)
+}
+
+func (s service) Each(filters Filters, opts listing.Options, fn func(enrollment domain.Enrollment) error) error {
+	return s.repository.Each(filters, opts, fn)
+}
+
+func (s service) Count(filters Filters) (int, error) {
+	return s.repository.Count(filters)
+}
+
+func (s service) Update(id string, version *int, status *string) error {
+	if status != nil && *status != domain.EnrollmentPending && *status != domain.EnrollmentCancelled {
+		return ErrInvalidStatus
+	}
+
+	return s.uow.Do(func(tx *gorm.DB) error {
+		repository := s.repository.WithTx(tx)
+		before, err := repository.GetForUpdate(id)
+
+		if err != nil {
+			return err
+		}
+
+		if err := repository.Update(id, version, status); err != nil {
+			return err
+		}
+
+		after, err := repository.Get(id)
+
+		if err != nil {
+			return err
+		}
+
+		return s.audit.WithTx(tx).Record("enrollment", id, audit.ActionUpdate, before, after)
+	})
+}
+
+func (s service) Batch(mode batch.Mode, n int, fn func(s Service, i int) (string, any, error), status func(error) int) ([]batch.Result, error) {
+	return batch.Run(s.uow, mode, n, func(tx *gorm.DB, i int) (string, any, error) {
+		return fn(s.WithTx(tx), i)
+	}, status)
+}
+
+// WithTx returns a copy of the service, and of the services it depends on,
+// joining the transaction; Create nests its own in it.
+func (s service) WithTx(tx *gorm.DB) Service {
+	s.repository = s.repository.WithTx(tx)
+	s.userService = s.userService.WithTx(tx)
+	s.courseService = s.courseService.WithTx(tx)
+	s.uow = uow.New(tx)
+	s.audit = s.audit.WithTx(tx)
+	return &s
+}
+
+// WithContext returns a copy of the service, and of the services it depends
+// on, bound to the request context.
+func (s service) WithContext(ctx context.Context) Service {
+	s.repository = s.repository.WithContext(ctx)
+	s.userService = s.userService.WithContext(ctx)
+	s.courseService = s.courseService.WithContext(ctx)
+	s.audit = s.audit.WithContext(ctx)
+	return &s
+}
+
 func NewService(
 	repository Repository,
 	logger *log.Logger,
 	userService user.Service,
 	courseService course.Service,
+	unitOfWork uow.UnitOfWork,
+	recorder audit.Recorder,
 ) Service {
 	return &service{
 		logger:        logger,
 		repository:    repository,
 		userService:   userService,
 		courseService: courseService,
+		uow:           unitOfWork,
+		audit:         recorder,
 	}
 }
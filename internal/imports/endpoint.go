@@ -0,0 +1,232 @@
+package imports
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+	"github.com/gorilla/mux"
+)
+
+// mapParam matches the "map[field]=column" parameters.
+var mapParam = regexp.MustCompile(`^map\[([a-z_]+)\]$`)
+
+// defaultTimeout replaces the server timeouts for imports when
+// IMPORT_TIMEOUT is not set.
+const defaultTimeout = 30 * time.Minute
+
+type Controller func(w http.ResponseWriter, r *http.Request)
+
+type Endpoints struct {
+	Users       Controller
+	Enrollments Controller
+	Get         Controller
+	Errors      Controller
+}
+
+type Response struct {
+	Status int        `json:"status"`
+	Data   any        `json:"data,omitempty"`
+	Err    string     `json:"error,omitempty"`
+	Meta   *meta.Meta `json:"meta,omitempty"`
+}
+
+func MakeEndpoints(s Service) Endpoints {
+	return Endpoints{
+		Users: makeImportEndpoint("users:write", func(s Service, r io.Reader, opts Options) (*domain.ImportJob, error) {
+			return s.Users(r, opts)
+		}, s),
+		Enrollments: makeImportEndpoint("enrollments:write", func(s Service, r io.Reader, opts Options) (*domain.ImportJob, error) {
+			return s.Enrollments(r, opts)
+		}, s),
+		Get:    makeGetEndpoint(s),
+		Errors: makeErrorsEndpoint(s),
+	}
+}
+
+// makeImportEndpoint reads the CSV from the body, or from the "file" part of
+// a multipart form, as it is uploaded. Besides the imports scope checked by
+// the route, the caller needs the scope creating the rows would need.
+func makeImportEndpoint(scope string, run func(s Service, r io.Reader, opts Options) (*domain.ImportJob, error), s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !auth.Allowed(r.Context(), scope) {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: "missing scope " + scope})
+			return
+		}
+
+		opts, err := options(r)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		// writers that can not extend the deadlines keep the server ones.
+		deadline := time.Now().Add(Timeout())
+		controller := http.NewResponseController(w)
+		controller.SetReadDeadline(deadline)
+		controller.SetWriteDeadline(deadline)
+
+		file, err := upload(r)
+
+		if tooLarge(err) {
+			w.WriteHeader(413)
+			json.NewEncoder(w).Encode(Response{Status: 413, Err: "file is too large"})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		job, err := run(s.WithContext(r.Context()), file, opts)
+
+		// the body limit can be hit while reading the header too.
+		if tooLarge(err) {
+			w.WriteHeader(413)
+			json.NewEncoder(w).Encode(Response{Status: 413, Data: job, Err: "file is too large"})
+			return
+		}
+
+		if errors.Is(err, ErrHeader) || errors.Is(err, ErrUnknownField) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Data: job, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Data: job, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: job})
+	}
+}
+
+func makeGetEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+		job, err := s.WithContext(r.Context()).Get(id)
+
+		if err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "import does not exist"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: job})
+	}
+}
+
+// makeErrorsEndpoint downloads the rows that failed as a CSV file.
+func makeErrorsEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+
+		if _, err := s.WithContext(r.Context()).Get(id); err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "import does not exist"})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="import-`+id+`-errors.csv"`)
+
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"row", "error"})
+
+		// the status is already sent, a failure can only truncate the file
+		s.EachError(id, func(e domain.ImportError) error {
+			return writer.Write([]string{strconv.Itoa(e.Row), e.Message})
+		})
+
+		writer.Flush()
+	}
+}
+
+// Timeout is how long an import may take to be uploaded and processed, from
+// IMPORT_TIMEOUT; large files outlast the server read and write timeouts.
+func Timeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("IMPORT_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultTimeout
+}
+
+// options reads dry_run, delimiter and the map[field]=column parameters.
+func options(r *http.Request) (Options, error) {
+	query := r.URL.Query()
+	opts := Options{DryRun: query.Get("dry_run") == "true", Mapping: map[string]string{}}
+
+	if delimiter := query.Get("delimiter"); delimiter != "" {
+		d, size := utf8.DecodeRuneInString(delimiter)
+
+		if size != len(delimiter) || d == '"' || d == '\r' || d == '\n' {
+			return opts, errors.New("delimiter must be a single character")
+		}
+
+		opts.Delimiter = d
+	}
+
+	for key := range query {
+		if match := mapParam.FindStringSubmatch(key); match != nil {
+			opts.Mapping[match[1]] = query.Get(key)
+		}
+	}
+
+	return opts, nil
+}
+
+// tooLarge tells whether err comes from the body limit.
+func tooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(err, &maxBytes)
+}
+
+func upload(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+
+	parts, err := r.MultipartReader()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := parts.NextPart()
+
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("file is required")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
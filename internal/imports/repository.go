@@ -0,0 +1,89 @@
+package imports
+
+import (
+	"context"
+	"log"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"gorm.io/gorm"
+)
+
+// errorBatchSize is the number of errors read at once by EachError.
+const errorBatchSize = 500
+
+type Repository interface {
+	Create(job *domain.ImportJob) error
+	Update(job *domain.ImportJob) error
+	Get(id string) (*domain.ImportJob, error)
+	AddErrors(errors []domain.ImportError) error
+	EachError(jobID string, fn func(domain.ImportError) error) error
+	WithContext(ctx context.Context) Repository
+}
+
+type repository struct {
+	logger *log.Logger
+	db     *gorm.DB
+}
+
+func (r repository) Create(job *domain.ImportJob) error {
+	if err := r.db.Create(job).Error; err != nil {
+		r.logger.Println(err)
+		return err
+	}
+
+	r.logger.Println("import job created with id: ", job.ID)
+	return nil
+}
+
+// Update saves the progress of a job.
+func (r repository) Update(job *domain.ImportJob) error {
+	err := r.db.Model(job).Select("status", "total_rows", "imported_rows", "failed_rows", "error", "finished_at").Updates(job).Error
+
+	if err != nil {
+		r.logger.Println(err)
+	}
+	return err
+}
+
+func (r repository) Get(id string) (*domain.ImportJob, error) {
+	job := domain.ImportJob{ID: id}
+	if err := r.db.First(&job).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (r repository) AddErrors(errors []domain.ImportError) error {
+	if len(errors) == 0 {
+		return nil
+	}
+
+	if err := r.db.Create(&errors).Error; err != nil {
+		r.logger.Println(err)
+		return err
+	}
+	return nil
+}
+
+// EachError calls fn for the errors of a job in row order, without loading
+// them all in memory.
+func (r repository) EachError(jobID string, fn func(domain.ImportError) error) error {
+	var batch []domain.ImportError
+
+	return r.db.Where("job_id = ?", jobID).FindInBatches(&batch, errorBatchSize, func(tx *gorm.DB, n int) error {
+		for _, e := range batch {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+func (r repository) WithContext(ctx context.Context) Repository {
+	return &repository{logger: r.logger, db: r.db.WithContext(ctx)}
+}
+
+func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
+	return &repository{logger: logger, db: db}
+}
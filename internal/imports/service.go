@@ -0,0 +1,335 @@
+package imports
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/enrollment"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/user"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
+	"gorm.io/gorm"
+)
+
+const (
+	KindUsers       = "users"
+	KindEnrollments = "enrollments"
+
+	// flushEvery is the number of rows between two saves of the progress.
+	flushEvery = 100
+)
+
+var (
+	UserFields       = []string{"first_name", "last_name", "email", "phone"}
+	EnrollmentFields = []string{"user_id", "user_email", "course_id"}
+
+	ErrUnknownField = errors.New("unknown field")
+	ErrHeader       = errors.New("invalid header")
+
+	// errDryRun rolls back the transaction of a row once it succeeded.
+	errDryRun = errors.New("dry run")
+)
+
+// Options of an import. Mapping gives, for a field, the column of the file
+// holding it; by default columns are named after the fields.
+type Options struct {
+	DryRun    bool
+	Mapping   map[string]string
+	Delimiter rune
+}
+
+type Service interface {
+	Users(r io.Reader, opts Options) (*domain.ImportJob, error)
+	Enrollments(r io.Reader, opts Options) (*domain.ImportJob, error)
+	// Get returns a job of the caller, the jobs of others are not found
+	// unless the caller holds every scope.
+	Get(id string) (*domain.ImportJob, error)
+	EachError(id string, fn func(domain.ImportError) error) error
+	WithContext(ctx context.Context) Service
+}
+
+type service struct {
+	ctx               context.Context
+	logger            *log.Logger
+	repository        Repository
+	uow               uow.UnitOfWork
+	userService       user.Service
+	enrollmentService enrollment.Service
+}
+
+// row imports the values of one line, indexed by field.
+type row func(tx *gorm.DB, values map[string]string) error
+
+func (s service) Users(r io.Reader, opts Options) (*domain.ImportJob, error) {
+	return s.run(KindUsers, r, opts, UserFields, func(tx *gorm.DB, values map[string]string) error {
+		for _, field := range []string{"first_name", "last_name", "email"} {
+			if values[field] == "" {
+				return fmt.Errorf("%s is required", field)
+			}
+		}
+
+		_, err := s.userService.WithTx(tx).Create(values["first_name"], values["last_name"], values["email"], values["phone"])
+		return err
+	})
+}
+
+// Enrollments identifies users by user_id or, when missing, by user_email.
+func (s service) Enrollments(r io.Reader, opts Options) (*domain.ImportJob, error) {
+	return s.run(KindEnrollments, r, opts, EnrollmentFields, func(tx *gorm.DB, values map[string]string) error {
+		userID := values["user_id"]
+
+		if userID == "" && values["user_email"] != "" {
+			u, err := s.userService.WithTx(tx).GetByEmail(values["user_email"])
+
+			if err != nil {
+				return enrollment.ErrUserNotFound
+			}
+
+			userID = u.ID
+		}
+
+		if userID == "" {
+			return errors.New("user_id or user_email is required")
+		}
+
+		if values["course_id"] == "" {
+			return errors.New("course_id is required")
+		}
+
+		_, err := s.enrollmentService.WithTx(tx).Create(userID, values["course_id"])
+		return err
+	})
+}
+
+func (s service) Get(id string) (*domain.ImportJob, error) {
+	job, err := s.repository.Get(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !owns(s.ctx, job) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return job, nil
+}
+
+func (s service) EachError(id string, fn func(domain.ImportError) error) error {
+	err := s.repository.EachError(id, fn)
+
+	if err != nil {
+		s.logger.Println(err)
+	}
+	return err
+}
+
+func (s service) WithContext(ctx context.Context) Service {
+	s.ctx = ctx
+	s.repository = s.repository.WithContext(ctx)
+	s.userService = s.userService.WithContext(ctx)
+	s.enrollmentService = s.enrollmentService.WithContext(ctx)
+	return &s
+}
+
+func NewService(
+	repository Repository,
+	logger *log.Logger,
+	unitOfWork uow.UnitOfWork,
+	userService user.Service,
+	enrollmentService enrollment.Service,
+) Service {
+	return &service{
+		ctx:               context.Background(),
+		logger:            logger,
+		repository:        repository,
+		uow:               unitOfWork,
+		userService:       userService,
+		enrollmentService: enrollmentService,
+	}
+}
+
+// run reads the file line by line, each row is imported in its own
+// transaction, rolled back in dry run mode, so a row never depends on the
+// others. The job is saved every flushEvery rows.
+func (s service) run(kind string, r io.Reader, opts Options, fields []string, fn row) (*domain.ImportJob, error) {
+	job := &domain.ImportJob{Kind: kind, Status: domain.ImportRunning, DryRun: opts.DryRun}
+
+	if err := s.repository.Create(job); err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	if opts.Delimiter != 0 {
+		reader.Comma = opts.Delimiter
+	}
+
+	header, err := reader.Read()
+
+	if err != nil {
+		return s.fail(job, fmt.Errorf("%w: %w", ErrHeader, err))
+	}
+
+	columns, err := mapColumns(header, fields, opts.Mapping)
+
+	if err != nil {
+		return s.fail(job, err)
+	}
+
+	var pending []domain.ImportError
+
+	for {
+		record, err := reader.Read()
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var (
+			line       int
+			parseError *csv.ParseError
+		)
+
+		switch {
+		case errors.As(err, &parseError):
+			line = parseError.Line
+		case err != nil:
+			return s.fail(job, err)
+		default:
+			line, _ = reader.FieldPos(0)
+			err = s.uow.Do(func(tx *gorm.DB) error {
+				if err := fn(tx, values(record, columns)); err != nil {
+					return err
+				}
+				if opts.DryRun {
+					return errDryRun
+				}
+				return nil
+			})
+
+			if errors.Is(err, errDryRun) {
+				err = nil
+			}
+		}
+
+		job.TotalRows++
+
+		if err != nil {
+			job.FailedRows++
+			pending = append(pending, domain.ImportError{JobID: job.ID, Row: line, Message: err.Error()})
+		} else {
+			job.ImportedRows++
+		}
+
+		if job.TotalRows%flushEvery == 0 {
+			if err := s.flush(job, pending); err != nil {
+				return nil, err
+			}
+			pending = pending[:0]
+		}
+	}
+
+	now := time.Now()
+	job.Status, job.FinishedAt = domain.ImportCompleted, &now
+
+	if err := s.flush(job, pending); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+func (s service) flush(job *domain.ImportJob, pending []domain.ImportError) error {
+	if err := s.repository.AddErrors(pending); err != nil {
+		return err
+	}
+	return s.repository.Update(job)
+}
+
+// fail stops a job on an error affecting the whole file, the error is
+// returned along with the job.
+func (s service) fail(job *domain.ImportJob, cause error) (*domain.ImportJob, error) {
+	now := time.Now()
+	job.Status, job.Error, job.FinishedAt = domain.ImportFailed, cause.Error(), &now
+
+	if err := s.repository.Update(job); err != nil {
+		s.logger.Println(err)
+	}
+
+	return job, cause
+}
+
+// mapColumns finds the index of every field in the header, matching names
+// case insensitively. Fields without column are left out.
+func mapColumns(header []string, fields []string, mapping map[string]string) (map[string]int, error) {
+	for field := range mapping {
+		if !slices.Contains(fields, field) {
+			return nil, fmt.Errorf("%w %s", ErrUnknownField, field)
+		}
+	}
+
+	index := make(map[string]int, len(header))
+
+	for i, name := range header {
+		name = strings.TrimPrefix(name, "\ufeff")
+		index[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	columns := make(map[string]int)
+
+	for _, field := range fields {
+		name := field
+		if mapped, ok := mapping[field]; ok {
+			name = mapped
+		}
+
+		i, ok := index[strings.ToLower(strings.TrimSpace(name))]
+
+		if !ok {
+			if _, mapped := mapping[field]; mapped {
+				return nil, fmt.Errorf("%w: column %q not found", ErrHeader, name)
+			}
+			continue
+		}
+
+		columns[field] = i
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("%w: no column matches %s", ErrHeader, strings.Join(fields, ", "))
+	}
+
+	return columns, nil
+}
+
+func values(record []string, columns map[string]int) map[string]string {
+	values := make(map[string]string, len(columns))
+
+	for field, i := range columns {
+		if i < len(record) {
+			values[field] = strings.TrimSpace(record[i])
+		}
+	}
+	return values
+}
+
+// owns tells whether the principal of ctx started the job, anonymous jobs
+// belong to anonymous callers.
+func owns(ctx context.Context, job *domain.ImportJob) bool {
+	p := auth.FromContext(ctx)
+
+	if p == nil {
+		return job.CreatedBy == ""
+	}
+	return job.CreatedBy == p.ID || p.Can(auth.AllScopes)
+}
@@ -0,0 +1,71 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+)
+
+const maxLimit = 100
+
+type Controller func(w http.ResponseWriter, r *http.Request)
+
+type Endpoints struct {
+	Search Controller
+}
+
+type Response struct {
+	Status int        `json:"status"`
+	Data   any        `json:"data,omitempty"`
+	Err    string     `json:"error,omitempty"`
+	Meta   *meta.Meta `json:"meta,omitempty"`
+}
+
+func MakeEndpoints(s Service) Endpoints {
+	return Endpoints{
+		Search: makeSearchEndpoint(s),
+	}
+}
+
+func makeSearchEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		limit, _ := strconv.Atoi(query.Get("limit"))
+
+		if limit <= 0 || limit > maxLimit {
+			limit = maxLimit
+		}
+
+		var types []string
+
+		if query.Get("type") != "" {
+			types = strings.Split(query.Get("type"), ",")
+		}
+
+		results, err := s.WithContext(r.Context()).Search(query.Get("q"), types, limit)
+
+		if errors.Is(err, ErrEmptyQuery) || errors.Is(err, ErrInvalidType) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if errors.Is(err, ErrForbiddenType) {
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(Response{Status: 403, Err: err.Error()})
+			return
+		}
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: results})
+	}
+}
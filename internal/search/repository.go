@@ -0,0 +1,64 @@
+package search
+
+import (
+	"context"
+	"log"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"gorm.io/gorm"
+)
+
+type UserHit struct {
+	domain.User
+	Score float64 `json:"-"`
+}
+
+type CourseHit struct {
+	domain.Course
+	Score float64 `json:"-"`
+}
+
+type Repository interface {
+	Users(q string, limit int) ([]UserHit, error)
+	Courses(q string, limit int) ([]CourseHit, error)
+	WithContext(ctx context.Context) Repository
+}
+
+type repository struct {
+	logger *log.Logger
+	db     *gorm.DB
+}
+
+func (r repository) Users(q string, limit int) ([]UserHit, error) {
+	var hits []UserHit
+
+	tx := domain.UserSearch.Match(r.db.Model(&domain.User{}), q)
+	tx = domain.UserSearch.Rank(tx, q)
+
+	if err := tx.Limit(limit).Scan(&hits).Error; err != nil {
+		r.logger.Println(err)
+		return nil, err
+	}
+	return hits, nil
+}
+
+func (r repository) Courses(q string, limit int) ([]CourseHit, error) {
+	var hits []CourseHit
+
+	tx := domain.CourseSearch.Match(r.db.Model(&domain.Course{}), q)
+	tx = domain.CourseSearch.Rank(tx, q)
+
+	if err := tx.Limit(limit).Scan(&hits).Error; err != nil {
+		r.logger.Println(err)
+		return nil, err
+	}
+	return hits, nil
+}
+
+func (r repository) WithContext(ctx context.Context) Repository {
+	return &repository{logger: r.logger, db: r.db.WithContext(ctx)}
+}
+
+func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
+	return &repository{logger: logger, db: db}
+}
@@ -0,0 +1,167 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sort"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fulltext"
+)
+
+const (
+	TypeUser   = "user"
+	TypeCourse = "course"
+)
+
+var (
+	ErrEmptyQuery    = errors.New("query is required")
+	ErrInvalidType   = errors.New("invalid type")
+	ErrForbiddenType = errors.New("missing scope to search this type")
+)
+
+// scopes are the scopes needed to see the results of each type, the same as
+// listing them.
+var scopes = map[string]string{
+	TypeUser:   "users:read",
+	TypeCourse: "courses:read",
+}
+
+// Result is a search hit: its relevance, a title and the snippets of the
+// matching fields, with the matches highlighted.
+type Result struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	// Score is relative to the best hit of the same type, 1, because the
+	// relevance computed by different indexes is not comparable.
+	Score      float64           `json:"score"`
+	Title      string            `json:"title"`
+	Highlights map[string]string `json:"highlights"`
+	Data       any               `json:"data"`
+}
+
+type Service interface {
+	Search(q string, types []string, limit int) ([]Result, error)
+	WithContext(ctx context.Context) Service
+}
+
+type service struct {
+	logger     *log.Logger
+	repository Repository
+	ctx        context.Context
+}
+
+// Search looks q up in the given types (all the caller can read when empty)
+// and returns up to limit results, the most relevant first.
+func (s service) Search(q string, types []string, limit int) ([]Result, error) {
+	if len(fulltext.Terms(q)) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	for _, t := range types {
+		if _, ok := scopes[t]; !ok {
+			return nil, ErrInvalidType
+		}
+
+		if !auth.Allowed(s.ctx, scopes[t]) {
+			return nil, ErrForbiddenType
+		}
+	}
+
+	if len(types) == 0 {
+		for _, t := range []string{TypeUser, TypeCourse} {
+			if auth.Allowed(s.ctx, scopes[t]) {
+				types = append(types, t)
+			}
+		}
+	}
+
+	results := []Result{}
+
+	if slices.Contains(types, TypeUser) {
+		users, err := s.repository.Users(q, limit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		best := 0.0
+
+		if len(users) > 0 {
+			best = users[0].Score
+		}
+
+		for _, u := range users {
+			results = append(results, newResult(TypeUser, u.ID, relative(u.Score, best), u.FirstName+" "+u.LastName, u.User, q, map[string]string{
+				"first_name": u.FirstName,
+				"last_name":  u.LastName,
+				"email":      u.Email,
+			}))
+		}
+	}
+
+	if slices.Contains(types, TypeCourse) {
+		courses, err := s.repository.Courses(q, limit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		best := 0.0
+
+		if len(courses) > 0 {
+			best = courses[0].Score
+		}
+
+		for _, c := range courses {
+			results = append(results, newResult(TypeCourse, c.ID, relative(c.Score, best), c.Name, c.Course, q, map[string]string{
+				"name": c.Name,
+			}))
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// WithContext returns a copy of the service bound to the request context,
+// whose principal decides the types it can search.
+func (s service) WithContext(ctx context.Context) Service {
+	s.repository = s.repository.WithContext(ctx)
+	s.ctx = ctx
+	return &s
+}
+
+func NewService(repository Repository, logger *log.Logger) Service {
+	return &service{logger: logger, repository: repository, ctx: context.Background()}
+}
+
+// relative scales a score by the best one of its type, the repository
+// returns the hits the most relevant first.
+func relative(score, best float64) float64 {
+	if best <= 0 {
+		return 0
+	}
+	return score / best
+}
+
+func newResult(kind, id string, score float64, title string, data any, q string, fields map[string]string) Result {
+	result := Result{Type: kind, ID: id, Score: score, Title: title, Highlights: map[string]string{}, Data: data}
+
+	for name, value := range fields {
+		if snippet, ok := fulltext.Highlight(value, q); ok {
+			result.Highlights[name] = snippet
+		}
+	}
+
+	return result
+}
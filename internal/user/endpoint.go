@@ -2,21 +2,57 @@ package user
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/batch"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/body"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/etag"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/export"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fields"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/httpcache"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
 	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
 	"github.com/gorilla/mux"
 )
 
 type Controller func(w http.ResponseWriter, r *http.Request)
 
+var (
+	// selectable are the fields accepted by the fields parameter.
+	selectable = []string{"id", "first_name", "last_name", "email", "phone", "phone_display", "email_verified_at", "version", "created_at", "updated_at", "created_by", "updated_by"}
+	// sortable are the fields accepted by the sort parameter of lists.
+	sortable = []string{"first_name", "last_name", "email", "created_at", "updated_at"}
+	// filterable are the fields accepted by the filter parameters of lists.
+	filterable = filter.Schema{
+		"first_name":        {Column: "first_name"},
+		"last_name":         {Column: "last_name"},
+		"email":             {Column: "email"},
+		"phone":             {Column: "phone"},
+		"email_verified_at": {Column: "email_verified_at", Kind: filter.Time},
+		"version":           {Column: "version", Kind: filter.Int},
+		"created_at":        {Column: "created_at", Kind: filter.Time},
+		"updated_at":        {Column: "updated_at", Kind: filter.Time},
+		"created_by":        {Column: "created_by"},
+		"updated_by":        {Column: "updated_by"},
+	}
+	// defaultSort lists the newest first.
+	defaultSort = []listing.Order{{Column: "created_at", Desc: true}}
+)
+
 type Endpoints struct {
-	Create Controller
-	Get    Controller
-	GetAll Controller
-	Update Controller
-	Delete Controller
+	Create      Controller
+	CreateBatch Controller
+	Get         Controller
+	GetAll      Controller
+	Update      Controller
+	Delete      Controller
+	Trash       Controller
+	Restore     Controller
+	Purge       Controller
 }
 
 type CreateRequest struct {
@@ -26,6 +62,13 @@ type CreateRequest struct {
 	Phone     string `json:"phone"`
 }
 
+// BatchCreateRequest creates several users, mode is "atomic" (default) or
+// "partial".
+type BatchCreateRequest struct {
+	Mode  string          `json:"mode"`
+	Items []CreateRequest `json:"items"`
+}
+
 type UpdateRequest struct {
 	FirstName *string `json:"first_name"`
 	LastName  *string `json:"last_name"`
@@ -42,11 +85,15 @@ type Response struct {
 
 func MakeEndpoints(s Service) Endpoints {
 	return Endpoints{
-		Create: makeCreateEndpoint(s),
-		Get:    makeGetEndpoint(s),
-		GetAll: makeGetAllEndpoint(s),
-		Update: makeUpdateEndpoint(s),
-		Delete: makeDeleteEndpoint(s),
+		Create:      makeCreateEndpoint(s),
+		CreateBatch: makeCreateBatchEndpoint(s),
+		Get:         makeGetEndpoint(s),
+		GetAll:      makeGetAllEndpoint(s),
+		Update:      makeUpdateEndpoint(s),
+		Delete:      makeDeleteEndpoint(s),
+		Trash:       makeTrashEndpoint(s),
+		Restore:     makeRestoreEndpoint(s),
+		Purge:       makePurgeEndpoint(s),
 	}
 }
 
@@ -54,31 +101,31 @@ func makeCreateEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var createRequest CreateRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&createRequest); err != nil {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "invalid request format"})
-			return
-		}
-
-		if createRequest.FirstName == "" {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "first name is required"})
+		if err := body.Decode(r, &createRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
 			return
 		}
 
-		if createRequest.LastName == "" {
+		if err := createRequest.validate(); err != nil {
 			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "last name is required"})
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
 			return
 		}
 
-		user, err := s.Create(
+		user, err := s.WithContext(r.Context()).Create(
 			createRequest.FirstName,
 			createRequest.LastName,
 			createRequest.Email,
 			createRequest.Phone,
 		)
 
+		if errors.Is(err, ErrEmailTaken) {
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(Response{Status: 409, Err: err.Error()})
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(400)
 			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
@@ -89,10 +136,68 @@ func makeCreateEndpoint(s Service) Controller {
 	}
 }
 
+func makeCreateBatchEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var batchRequest BatchCreateRequest
+
+		if err := body.Decode(r, &batchRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
+			return
+		}
+
+		mode, err := batch.ParseMode(batchRequest.Mode)
+
+		if err == nil {
+			err = batch.Check(len(batchRequest.Items))
+		}
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		results, err := s.WithContext(r.Context()).Batch(mode, len(batchRequest.Items), func(s Service, i int) (string, any, error) {
+			item := batchRequest.Items[i]
+
+			if err := item.validate(); err != nil {
+				return "", nil, err
+			}
+
+			user, err := s.Create(item.FirstName, item.LastName, item.Email, item.Phone)
+
+			if err != nil {
+				return "", nil, err
+			}
+
+			return user.ID, user, nil
+		}, createStatus)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		status := batch.Status(mode, results)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(Response{Status: status, Data: results})
+	}
+}
+
 func makeGetEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := mux.Vars(r)
 		id := path["id"]
+		selected, err := fields.Parse(r.URL.Query().Get("fields"), selectable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
 		user, err := s.Get(id)
 
 		if err != nil {
@@ -101,7 +206,19 @@ func makeGetEndpoint(s Service) Controller {
 			return
 		}
 
-		json.NewEncoder(w).Encode(Response{Status: 200, Data: user})
+		if httpcache.Validate(w, r, etag.Version(user.Version), user.UpdatedAt) {
+			return
+		}
+
+		data, err := fields.Select(user, selected)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: data})
 	}
 }
 
@@ -111,19 +228,79 @@ func makeGetAllEndpoint(s Service) Controller {
 		filters := Filters{
 			FirstName: query.Get("first_name"),
 			LastName:  query.Get("last_name"),
+			Email:     query.Get("email"),
+			Phone:     query.Get("phone"),
 		}
 
-		count, err := s.Count(filters)
+		if err := listing.ParseTimeFilters(query, &filters.UpdatedSince, &filters.CreatedBefore); err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		conditions, err := filter.Parse(query, filterable)
 
 		if err != nil {
-			w.WriteHeader(500)
-			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
 			return
 		}
 
-		limit, _ := strconv.Atoi(query.Get("limit"))
-		page, _ := strconv.Atoi(query.Get("page"))
-		meta, err := meta.New(page, limit, count)
+		filters.Conditions = conditions
+
+		selected, err := fields.Parse(query.Get("fields"), selectable)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		filters.Search = query.Get("q")
+
+		// searches are ranked by relevance unless a sort is given.
+		fallback := defaultSort
+		if filters.Search != "" {
+			fallback = nil
+		}
+
+		sort, err := listing.ParseSort(query.Get("sort"), sortable, fallback)
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		if format, ok := export.Negotiate(w, r); ok {
+			limit, err := export.Limit(w, func() (int, error) { return s.Count(filters) })
+
+			if err != nil {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+				return
+			}
+
+			opts := listing.Options{Sort: sort, Limit: limit}
+
+			err = export.Stream(w, format, "users", fields.Columns(selected, selectable), func(write func(row any) error) error {
+				return s.Each(filters, opts, func(user domain.User) error { return write(user) })
+			})
+
+			if err != nil && !errors.Is(err, export.ErrTruncated) {
+				w.WriteHeader(500)
+				json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			}
+			return
+		}
+
+		meta, opts, err := listing.New(query, sort, func() (int, error) { return s.Count(filters) })
+
+		if errors.Is(err, listing.ErrInvalidCursor) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
 
 		if err != nil {
 			w.WriteHeader(500)
@@ -131,7 +308,11 @@ func makeGetAllEndpoint(s Service) Controller {
 			return
 		}
 
-		users, err := s.GetAll(filters, meta.Offset(), meta.Limit())
+		users, err := s.GetAll(filters, opts)
+
+		if err == nil {
+			users, err = listing.Page(users, opts, meta)
+		}
 
 		if err != nil {
 			w.WriteHeader(400)
@@ -139,9 +320,34 @@ func makeGetAllEndpoint(s Service) Controller {
 			return
 		}
 
+		tag := []string{r.URL.RawQuery}
+		if meta.TotalCount != nil {
+			tag = append(tag, strconv.Itoa(*meta.TotalCount))
+		}
+
+		for _, user := range users {
+			tag = append(tag, user.ID, strconv.Itoa(user.Version))
+		}
+
+		// rows deleted or leaving the page change no updated_at, lists have no
+		// Last-Modified and are only validated by their tag.
+		if httpcache.Validate(w, r, httpcache.Tag(tag...), nil) {
+			return
+		}
+
+		data, err := fields.Select(users, selected)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		listing.Link(w, r, meta)
+
 		json.NewEncoder(w).Encode(Response{
 			Status: 200,
-			Data:   users,
+			Data:   data,
 			Meta:   meta,
 		})
 	}
@@ -151,9 +357,9 @@ func makeUpdateEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var updateRequest UpdateRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&updateRequest); err != nil {
-			w.WriteHeader(400)
-			json.NewEncoder(w).Encode(Response{Status: 400, Err: "invalid request format"})
+		if err := body.Decode(r, &updateRequest); err != nil {
+			w.WriteHeader(body.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: body.Status(err), Err: err.Error()})
 			return
 		}
 
@@ -169,17 +375,50 @@ func makeUpdateEndpoint(s Service) Controller {
 			return
 		}
 
+		if updateRequest.Email != nil && *updateRequest.Email == "" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: "email is required"})
+			return
+		}
+
+		version, err := etag.IfMatch(r)
+
+		if err != nil {
+			w.WriteHeader(etag.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: etag.Status(err), Err: err.Error()})
+			return
+		}
+
 		path := mux.Vars(r)
 		id := path["id"]
 
-		err := s.Update(
+		err = s.WithContext(r.Context()).Update(
 			id,
+			version,
 			updateRequest.FirstName,
 			updateRequest.LastName,
 			updateRequest.Email,
 			updateRequest.Phone,
 		)
 
+		if errors.Is(err, ErrVersionConflict) {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(Response{Status: 412, Err: err.Error()})
+			return
+		}
+
+		if errors.Is(err, ErrEmailTaken) {
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(Response{Status: 409, Err: err.Error()})
+			return
+		}
+
+		if errors.Is(err, ErrInvalidEmail) || errors.Is(err, ErrInvalidPhone) {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
 		if err != nil {
 			w.WriteHeader(404)
 			json.NewEncoder(w).Encode(Response{Status: 404, Err: "user does not exist"})
@@ -192,9 +431,29 @@ func makeUpdateEndpoint(s Service) Controller {
 
 func makeDeleteEndpoint(s Service) Controller {
 	return func(w http.ResponseWriter, r *http.Request) {
+		version, err := etag.IfMatch(r)
+
+		if err != nil {
+			w.WriteHeader(etag.Status(err))
+			json.NewEncoder(w).Encode(Response{Status: etag.Status(err), Err: err.Error()})
+			return
+		}
+
 		path := mux.Vars(r)
 		id := path["id"]
-		err := s.Delete(id)
+		result, err := s.WithContext(r.Context()).Delete(id, version)
+
+		if errors.Is(err, ErrVersionConflict) {
+			w.WriteHeader(412)
+			json.NewEncoder(w).Encode(Response{Status: 412, Err: err.Error()})
+			return
+		}
+
+		if errors.Is(err, ErrActiveEnrollments) {
+			w.WriteHeader(409)
+			json.NewEncoder(w).Encode(Response{Status: 409, Err: err.Error()})
+			return
+		}
 
 		if err != nil {
 			w.WriteHeader(404)
@@ -202,6 +461,95 @@ func makeDeleteEndpoint(s Service) Controller {
 			return
 		}
 
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: result})
+	}
+}
+
+func makeTrashEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		count, err := s.CountDeleted()
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		page, _ := strconv.Atoi(query.Get("page"))
+		meta, err := meta.New(page, limit, count)
+
+		if err != nil {
+			w.WriteHeader(500)
+			json.NewEncoder(w).Encode(Response{Status: 500, Err: err.Error()})
+			return
+		}
+
+		users, err := s.GetDeleted(meta.Offset(), meta.Limit())
+
+		if err != nil {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(Response{Status: 400, Err: err.Error()})
+			return
+		}
+
+		listing.Link(w, r, meta)
+
+		json.NewEncoder(w).Encode(Response{
+			Status: 200,
+			Data:   users,
+			Meta:   meta,
+		})
+	}
+}
+
+func makeRestoreEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+
+		if err := s.WithContext(r.Context()).Restore(id); err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "user is not in the trash"})
+			return
+		}
+
 		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
 	}
 }
+
+func makePurgeEndpoint(s Service) Controller {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)
+		id := path["id"]
+
+		if err := s.WithContext(r.Context()).Purge(id); err != nil {
+			w.WriteHeader(404)
+			json.NewEncoder(w).Encode(Response{Status: 404, Err: "user is not in the trash"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(Response{Status: 200, Data: "success"})
+	}
+}
+
+func (r CreateRequest) validate() error {
+	switch {
+	case r.FirstName == "":
+		return errors.New("first name is required")
+	case r.LastName == "":
+		return errors.New("last name is required")
+	case r.Email == "":
+		return errors.New("email is required")
+	}
+	return nil
+}
+
+// createStatus maps the errors of a batch item to the codes of POST /users.
+func createStatus(err error) int {
+	if errors.Is(err, ErrEmailTaken) {
+		return 409
+	}
+	return 400
+}
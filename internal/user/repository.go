@@ -1,21 +1,41 @@
 package user
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/etag"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repository interface {
 	Create(user *domain.User) error
-	GetAll(filters Filters, offset, limit int) ([]domain.User, error)
+	GetAll(filters Filters, opts listing.Options) ([]domain.User, error)
+	Each(filters Filters, opts listing.Options, fn func(user domain.User) error) error
 	Get(id string) (*domain.User, error)
-	Delete(id string) error
-	Update(id string, firstName, lastName, email, phone *string) error
+	GetForUpdate(id string) (*domain.User, error)
+	GetByEmail(email string) (*domain.User, error)
+	// GetByEmailWithDeleted also finds soft deleted users, which keep their
+	// email in the unique index.
+	GetByEmailWithDeleted(email string) (*domain.User, error)
+	Delete(id string, version *int, policy domain.DeletePolicy) (before, after []domain.Enrollment, err error)
+	Update(id string, version *int, firstName, lastName, email, phone, phoneDisplay *string) error
 	Count(filters Filters) (int, error)
+	GetDeleted(offset, limit int) ([]domain.User, error)
+	CountDeleted() (int, error)
+	Restore(id string) error
+	Purge(id string) ([]domain.Enrollment, error)
+	GetDeletedBefore(before time.Time) ([]string, error)
+	WithTx(tx *gorm.DB) Repository
+	WithContext(ctx context.Context) Repository
 }
 
 type repository struct {
@@ -26,6 +46,9 @@ type repository struct {
 func (r repository) Create(user *domain.User) error {
 	if err := r.db.Create(user).Error; err != nil {
 		r.logger.Println(err)
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return ErrEmailTaken
+		}
 		return err
 	}
 
@@ -33,21 +56,65 @@ func (r repository) Create(user *domain.User) error {
 	return nil
 }
 
-func (r repository) GetAll(filters Filters, offset, limit int) ([]domain.User, error) {
+func (r repository) GetAll(filters Filters, opts listing.Options) ([]domain.User, error) {
 	var users []domain.User
 
-	tx := r.db.Model(&users)
+	tx, err := r.list(filters, opts)
 
-	tx = applyFilters(tx, filters)
-
-	tx = tx.Limit(limit).Offset(offset)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := tx.Order("created_at desc").Find(&users).Error; err != nil {
+	if err := tx.Find(&users).Error; err != nil {
 		return nil, err
 	}
 	return users, nil
 }
 
+// Each streams the users of GetAll to fn with a cursor, without loading
+// them all in memory.
+func (r repository) Each(filters Filters, opts listing.Options, fn func(user domain.User) error) error {
+	tx, err := r.list(filters, opts)
+
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Rows()
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var user domain.User
+
+		if err := tx.ScanRows(rows, &user); err != nil {
+			return err
+		}
+
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r repository) list(filters Filters, opts listing.Options) (*gorm.DB, error) {
+	tx := r.db.Model(&domain.User{})
+
+	tx = applyFilters(tx, filters)
+
+	// without an explicit sort, searches list the most relevant rows first.
+	if filters.Search != "" && len(opts.Sort) == 0 {
+		tx = domain.UserSearch.Rank(tx, filters.Search)
+	}
+
+	return listing.Apply(tx, opts)
+}
+
 func (r repository) Get(id string) (*domain.User, error) {
 	user := domain.User{ID: id}
 	if err := r.db.First(&user).Error; err != nil {
@@ -56,16 +123,119 @@ func (r repository) Get(id string) (*domain.User, error) {
 	return &user, nil
 }
 
-func (r repository) Delete(id string) error {
+// GetForUpdate locks the row until the end of the transaction, so it can not
+// be updated or deleted concurrently.
+func (r repository) GetForUpdate(id string) (*domain.User, error) {
 	user := domain.User{ID: id}
+	if err := r.db.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
 
-	if err := r.db.Delete(&user).Error; err != nil {
-		return err
+func (r repository) GetByEmail(email string) (*domain.User, error) {
+	var user domain.User
+	if err := r.db.Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
 	}
-	return nil
+	return &user, nil
+}
+
+func (r repository) GetByEmailWithDeleted(email string) (*domain.User, error) {
+	var user domain.User
+	if err := r.db.Unscoped().Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-func (r repository) Update(id string, firstName, lastName, email, phone *string) error {
+// Delete soft deletes the user and applies the policy to its enrollments in
+// the same transaction. The user is locked first, like enrollment.Create
+// does, so no enrollment can be added while they are counted. It returns the
+// affected enrollments before and after the policy, after is empty when they
+// are deleted.
+func (r repository) Delete(id string, version *int, policy domain.DeletePolicy) (before, after []domain.Enrollment, err error) {
+	err = r.db.Transaction(func(tx *gorm.DB) error {
+		locked := repository{logger: r.logger, db: tx}
+
+		if _, err := locked.GetForUpdate(id); err != nil {
+			return err
+		}
+
+		active := func() *gorm.DB {
+			return tx.Model(&domain.Enrollment{}).
+				Where("user_id = ? AND status <> ?", id, domain.EnrollmentCancelled)
+		}
+
+		switch policy {
+		case domain.DeleteCancel:
+			if err := active().Clauses(clause.Locking{Strength: "UPDATE"}).Order("id").Find(&before).Error; err != nil {
+				return err
+			}
+			if len(before) == 0 {
+				break
+			}
+			err := tx.Model(&domain.Enrollment{}).Where("id IN ?", ids(before)).Updates(map[string]interface{}{
+				"status":  domain.EnrollmentCancelled,
+				"version": gorm.Expr("version + 1"),
+			}).Error
+			if err != nil {
+				return err
+			}
+			if err := tx.Where("id IN ?", ids(before)).Order("id").Find(&after).Error; err != nil {
+				return err
+			}
+		case domain.DeleteCascade:
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", id).Order("id").Find(&before).Error; err != nil {
+				return err
+			}
+			if len(before) == 0 {
+				break
+			}
+			if err := domain.SoftDelete(tx.Where("id IN ?", ids(before)), &domain.Enrollment{}).Error; err != nil {
+				return err
+			}
+		default:
+			var count int64
+			if err := active().Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrActiveEnrollments
+			}
+		}
+
+		result := domain.SoftDelete(etag.WhereVersion(tx, version), &domain.User{ID: id})
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return locked.missing(id)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.logger.Printf("user deleted with id: %s, %d enrollments affected (%s)", id, len(before), policy)
+	return before, after, nil
+}
+
+func ids(enrollments []domain.Enrollment) []string {
+	result := make([]string, len(enrollments))
+
+	for i, e := range enrollments {
+		result[i] = e.ID
+	}
+	return result
+}
+
+func (r repository) Update(id string, version *int, firstName, lastName, email, phone, phoneDisplay *string) error {
 	values := make(map[string]interface{}, 0)
 
 	if firstName != nil {
@@ -84,10 +254,40 @@ func (r repository) Update(id string, firstName, lastName, email, phone *string)
 		values["phone"] = *phone
 	}
 
-	if err := r.db.Model(&domain.User{}).Where("id = ?", id).Updates(values).Error; err != nil {
-		return err
+	if phoneDisplay != nil {
+		values["phone_display"] = *phoneDisplay
 	}
-	return nil
+
+	values["version"] = gorm.Expr("version + 1")
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		// a new email has to be verified again, the update runs on the same
+		// version so a conflict rolls this back too.
+		if email != nil {
+			unverify := etag.WhereVersion(tx.Model(&domain.User{}).Where("id = ? AND email <> ?", id, *email), version).
+				UpdateColumn("email_verified_at", nil)
+
+			if err := unverify.Error; err != nil {
+				return err
+			}
+		}
+
+		updated := etag.WhereVersion(tx.Model(&domain.User{}).Where("id = ?", id), version).Updates(values)
+
+		if err := updated.Error; err != nil {
+			return err
+		}
+
+		if updated.RowsAffected == 0 {
+			return r.missing(id)
+		}
+		return nil
+	})
+
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrEmailTaken
+	}
+	return err
 }
 
 func (r repository) Count(filters Filters) (int, error) {
@@ -103,6 +303,113 @@ func (r repository) Count(filters Filters) (int, error) {
 	return int(count), nil
 }
 
+func (r repository) GetDeleted(offset, limit int) ([]domain.User, error) {
+	var users []domain.User
+
+	tx := r.db.Unscoped().Where("deleted IS NOT NULL").Limit(limit).Offset(offset)
+
+	if err := tx.Order("deleted desc").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (r repository) CountDeleted() (int, error) {
+	var count int64
+
+	if err := r.db.Unscoped().Model(domain.User{}).Where("deleted IS NOT NULL").Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (r repository) Restore(id string) error {
+	tx := r.db.Unscoped().Model(&domain.User{}).
+		Where("id = ? AND deleted IS NOT NULL", id).
+		Updates(map[string]interface{}{"deleted": nil, "version": gorm.Expr("version + 1")})
+
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if tx.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	r.logger.Println("user restored with id: ", id)
+	return nil
+}
+
+// Purge permanently removes a trashed user with its enrollments, which
+// restrict the deletion of the user, returning the enrollments removed.
+func (r repository) Purge(id string) ([]domain.Enrollment, error) {
+	var enrollments []domain.Enrollment
+
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var user domain.User
+
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? AND deleted IS NOT NULL", id).
+			First(&user).Error
+
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Where("user_id = ?", id).Order("id").Find(&enrollments).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Where("user_id = ?", id).Delete(&domain.Enrollment{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&user).Error
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.logger.Printf("user purged with id: %s, %d enrollments removed", id, len(enrollments))
+	return enrollments, nil
+}
+
+// GetDeletedBefore returns the ids of the users trashed before the date.
+func (r repository) GetDeletedBefore(before time.Time) ([]string, error) {
+	var ids []string
+
+	err := r.db.Unscoped().Model(&domain.User{}).
+		Where("deleted IS NOT NULL AND deleted < ?", before).
+		Order("deleted").
+		Pluck("id", &ids).Error
+
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// missing tells why a versioned write did not change any row.
+func (r repository) missing(id string) error {
+	if _, err := r.Get(id); err != nil {
+		return err
+	}
+	return ErrVersionConflict
+}
+
+// WithTx keeps the context of the repository, the transaction may have been
+// started from a db without it.
+func (r repository) WithTx(tx *gorm.DB) Repository {
+	return &repository{logger: r.logger, db: tx.WithContext(r.db.Statement.Context)}
+}
+
+// WithContext makes the context, and the principal it carries, available to
+// the model hooks.
+func (r repository) WithContext(ctx context.Context) Repository {
+	return &repository{logger: r.logger, db: r.db.WithContext(ctx)}
+}
+
 func NewRepository(logger *log.Logger, db *gorm.DB) Repository {
 	return &repository{logger: logger, db: db}
 }
@@ -118,5 +425,27 @@ func applyFilters(tx *gorm.DB, filters Filters) *gorm.DB {
 		tx = tx.Where("lower(last_name) like ?", filters.LastName)
 	}
 
+	if filters.Email != "" {
+		tx = tx.Where("email = ?", filters.Email)
+	}
+
+	if filters.Phone != "" {
+		tx = tx.Where("phone = ?", filters.Phone)
+	}
+
+	if filters.UpdatedSince != nil {
+		tx = tx.Where("updated_at >= ?", *filters.UpdatedSince)
+	}
+
+	if filters.CreatedBefore != nil {
+		tx = tx.Where("created_at < ?", *filters.CreatedBefore)
+	}
+
+	if filters.Search != "" {
+		tx = domain.UserSearch.Match(tx, filters.Search)
+	}
+
+	tx = filter.Apply(tx, filters.Conditions)
+
 	return tx
 }
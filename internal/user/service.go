@@ -1,47 +1,130 @@
 package user
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/mail"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/audit"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/batch"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/filter"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/listing"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/phone"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
+	"gorm.io/gorm"
 )
 
 type Service interface {
 	Create(firstName, lastName, email, phone string) (*domain.User, error)
-	GetAll(filters Filters, offset, limit int) ([]domain.User, error)
+	GetAll(filters Filters, opts listing.Options) ([]domain.User, error)
+	// Each streams the users matching the filters to fn, for exports.
+	Each(filters Filters, opts listing.Options, fn func(user domain.User) error) error
 	Get(id string) (*domain.User, error)
-	Delete(id string) error
-	Update(id string, firstName, lastName, email, phone *string) error
+	GetForUpdate(id string) (*domain.User, error)
+	GetByEmail(email string) (*domain.User, error)
+	Delete(id string, version *int) (*domain.DeleteResult, error)
+	Update(id string, version *int, firstName, lastName, email, phone *string) error
 	Count(filters Filters) (int, error)
+	GetDeleted(offset, limit int) ([]domain.User, error)
+	CountDeleted() (int, error)
+	Restore(id string) error
+	Purge(id string) error
+	PurgeExpired(retention time.Duration) (int, error)
+	// Batch runs fn for n items in one transaction, fn gets the service
+	// bound to the savepoint of its item, see batch.Run.
+	Batch(mode batch.Mode, n int, fn func(s Service, i int) (string, any, error), status func(error) int) ([]batch.Result, error)
+	WithTx(tx *gorm.DB) Service
+	WithContext(ctx context.Context) Service
 }
 
 type Filters struct {
-	FirstName string
-	LastName  string
+	FirstName     string
+	LastName      string
+	Email         string
+	Phone         string
+	UpdatedSince  *time.Time
+	CreatedBefore *time.Time
+	// Search keeps the rows matching a full text query.
+	Search string
+	// Conditions come from the filter[field][operator] parameters.
+	Conditions []filter.Condition
 }
 
+// maxEmailLength is the size of the email column.
+const maxEmailLength = 50
+
+var (
+	ErrInvalidEmail = errors.New("invalid email")
+	ErrEmailTaken   = errors.New("email is already in use")
+	// ErrEmailInTrash is an ErrEmailTaken, the unique index also covers the
+	// soft deleted users.
+	ErrEmailInTrash = fmt.Errorf("%w by a deleted user, restore or purge it first", ErrEmailTaken)
+	ErrInvalidPhone = errors.New("invalid phone number")
+
+	ErrActiveEnrollments = errors.New("user has active enrollments")
+	ErrVersionConflict   = errors.New("user was modified by another request")
+)
+
 type service struct {
-	logger     *log.Logger
-	repository Repository
+	logger       *log.Logger
+	repository   Repository
+	phoneRegion  string
+	deletePolicy domain.DeletePolicy
+	uow          uow.UnitOfWork
+	audit        audit.Recorder
 }
 
 func (s service) Create(firstName, lastName, email, phone string) (*domain.User, error) {
+	email, err := normalizeEmail(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ensureEmailAvailable(email, ""); err != nil {
+		return nil, err
+	}
+
+	normalizedPhone, err := s.normalizePhone(phone)
+
+	if err != nil {
+		return nil, err
+	}
+
 	user := &domain.User{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-		Phone:     phone,
+		FirstName:    firstName,
+		LastName:     lastName,
+		Email:        email,
+		Phone:        normalizedPhone,
+		PhoneDisplay: strings.TrimSpace(phone),
 	}
 
-	if err := s.repository.Create(user); err != nil {
+	err = s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+
+		if err := s.repository.Create(user); err != nil {
+			return err
+		}
+
+		return s.audit.Record("user", user.ID, audit.ActionCreate, nil, user)
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
 
-func (s service) GetAll(filters Filters, offset, limit int) ([]domain.User, error) {
-	users, err := s.repository.GetAll(filters, offset, limit)
+func (s service) GetAll(filters Filters, opts listing.Options) ([]domain.User, error) {
+	filters = s.normalizeFilters(filters)
+	users, err := s.repository.GetAll(filters, opts)
 
 	if err != nil {
 		return nil, err
@@ -50,6 +133,11 @@ func (s service) GetAll(filters Filters, offset, limit int) ([]domain.User, erro
 	return users, nil
 }
 
+func (s service) Each(filters Filters, opts listing.Options, fn func(user domain.User) error) error {
+	filters = s.normalizeFilters(filters)
+	return s.repository.Each(filters, opts, fn)
+}
+
 func (s service) Get(id string) (*domain.User, error) {
 	user, err := s.repository.Get(id)
 
@@ -60,18 +148,366 @@ func (s service) Get(id string) (*domain.User, error) {
 	return user, nil
 }
 
-func (s service) Delete(id string) error {
-	return s.repository.Delete(id)
+func (s service) GetByEmail(email string) (*domain.User, error) {
+	email, err := normalizeEmail(email)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repository.GetByEmail(email)
 }
 
-func (s service) Update(id string, firstName, lastName, email, phone *string) error {
-	return s.repository.Update(id, firstName, lastName, email, phone)
+func (s service) GetForUpdate(id string) (*domain.User, error) {
+	return s.repository.GetForUpdate(id)
+}
+
+func (s service) Delete(id string, version *int) (*domain.DeleteResult, error) {
+	var affected int
+
+	err := s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+		before, err := s.repository.GetForUpdate(id)
+
+		if err != nil {
+			return err
+		}
+
+		enrollments, cancelled, err := s.repository.Delete(id, version, s.deletePolicy)
+
+		if err != nil {
+			return err
+		}
+
+		affected = len(enrollments)
+
+		if err := s.audit.Record("user", id, audit.ActionDelete, before, nil); err != nil {
+			return err
+		}
+
+		return s.auditEnrollments(enrollments, cancelled)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain.DeleteResult{Policy: s.deletePolicy, Enrollments: affected}, nil
+}
+
+// auditEnrollments records what the delete policy did to the enrollments,
+// the ones missing from after were deleted.
+func (s service) auditEnrollments(before, after []domain.Enrollment) error {
+	for i := range before {
+		var err error
+
+		if i < len(after) {
+			err = s.audit.Record("enrollment", before[i].ID, audit.ActionUpdate, &before[i], &after[i])
+		} else {
+			err = s.audit.Record("enrollment", before[i].ID, audit.ActionDelete, &before[i], nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s service) Update(id string, version *int, firstName, lastName, email, phone *string) error {
+	if email != nil {
+		normalized, err := normalizeEmail(*email)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s.ensureEmailAvailable(normalized, id); err != nil {
+			return err
+		}
+
+		email = &normalized
+	}
+
+	var phoneDisplay *string
+
+	if phone != nil {
+		normalized, err := s.normalizePhone(*phone)
+
+		if err != nil {
+			return err
+		}
+
+		display := strings.TrimSpace(*phone)
+		phone, phoneDisplay = &normalized, &display
+	}
+
+	return s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+		before, err := s.repository.GetForUpdate(id)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s.repository.Update(id, version, firstName, lastName, email, phone, phoneDisplay); err != nil {
+			return err
+		}
+
+		after, err := s.repository.Get(id)
+
+		if err != nil {
+			return err
+		}
+
+		return s.audit.Record("user", id, audit.ActionUpdate, before, after)
+	})
 }
 
 func (s service) Count(filters Filters) (int, error) {
+	filters = s.normalizeFilters(filters)
 	return s.repository.Count(filters)
 }
 
-func NewService(repository Repository, logger *log.Logger) Service {
-	return &service{logger: logger, repository: repository}
+func (s service) ensureEmailAvailable(email, id string) error {
+	user, err := s.repository.GetByEmailWithDeleted(email)
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if user.ID != id && user.Deleted.Valid {
+		return ErrEmailInTrash
+	}
+
+	if user.ID != id {
+		return ErrEmailTaken
+	}
+
+	return nil
+}
+
+// normalizePhone stores numbers in E.164, numbers typed without an
+// international prefix belong to the configured default region.
+func (s service) normalizePhone(raw string) (string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return "", nil
+	}
+
+	normalized, err := phone.Normalize(raw, s.phoneRegion)
+
+	if err != nil {
+		s.logger.Println(err)
+		return "", ErrInvalidPhone
+	}
+
+	return normalized, nil
+}
+
+func (s service) normalizePhoneFilter(raw string) string {
+	if normalized, err := phone.Normalize(raw, s.phoneRegion); err == nil {
+		return normalized
+	}
+	return strings.TrimSpace(raw)
+}
+
+// separators are typed in phones but never stored.
+var separators = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+
+// normalizeFilters brings the email and phone filters, the filter[...]
+// conditions included, to the form they are stored in.
+func (s service) normalizeFilters(filters Filters) Filters {
+	filters.Email = normalizeEmailFilter(filters.Email)
+	filters.Phone = s.normalizePhoneFilter(filters.Phone)
+
+	conditions := make([]filter.Condition, len(filters.Conditions))
+
+	for i, c := range filters.Conditions {
+		switch {
+		case c.Column == "email" && c.Operator != filter.Contains:
+			c.Value = mapStrings(c.Value, normalizeEmailFilter)
+		case c.Column == "phone" && c.Operator != filter.Contains:
+			c.Value = mapStrings(c.Value, s.normalizePhoneFilter)
+		case c.Column == "phone":
+			c.Value = mapStrings(c.Value, separators.Replace)
+		}
+		conditions[i] = c
+	}
+
+	filters.Conditions = conditions
+	return filters
+}
+
+// mapStrings applies fn to a condition value, or to each value of an "in".
+func mapStrings(value any, fn func(string) string) any {
+	switch v := value.(type) {
+	case string:
+		return fn(v)
+	case []any:
+		mapped := make([]any, len(v))
+
+		for i, item := range v {
+			mapped[i] = mapStrings(item, fn)
+		}
+		return mapped
+	default:
+		return value
+	}
+}
+
+func (s service) GetDeleted(offset, limit int) ([]domain.User, error) {
+	return s.repository.GetDeleted(offset, limit)
+}
+
+func (s service) CountDeleted() (int, error) {
+	return s.repository.CountDeleted()
+}
+
+func (s service) Restore(id string) error {
+	return s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+
+		if err := s.repository.Restore(id); err != nil {
+			return err
+		}
+
+		after, err := s.repository.Get(id)
+
+		if err != nil {
+			return err
+		}
+
+		return s.audit.Record("user", id, audit.ActionRestore, nil, after)
+	})
+}
+
+func (s service) Purge(id string) error {
+	return s.uow.Do(func(tx *gorm.DB) error {
+		s := s.withTx(tx)
+		enrollments, err := s.repository.Purge(id)
+
+		if err != nil {
+			return err
+		}
+
+		if err := s.audit.Record("user", id, audit.ActionPurge, nil, nil); err != nil {
+			return err
+		}
+
+		// the audit log keeps the history of the enrollments removed.
+		for i := range enrollments {
+			if err := s.audit.Record("enrollment", enrollments[i].ID, audit.ActionPurge, &enrollments[i], nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeExpired permanently removes the users deleted more than retention
+// ago, one at a time like Purge so each one is audited.
+func (s service) PurgeExpired(retention time.Duration) (int, error) {
+	ids, err := s.repository.GetDeletedBefore(time.Now().Add(-retention))
+
+	if err != nil {
+		s.logger.Println(err)
+		return 0, err
+	}
+
+	purged := 0
+
+	for _, id := range ids {
+		// restored meanwhile
+		if err := s.Purge(id); errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			s.logger.Println(err)
+			return purged, err
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		s.logger.Printf("%d users purged from trash", purged)
+	}
+	return purged, nil
+}
+
+func (s service) Batch(mode batch.Mode, n int, fn func(s Service, i int) (string, any, error), status func(error) int) ([]batch.Result, error) {
+	return batch.Run(s.uow, mode, n, func(tx *gorm.DB, i int) (string, any, error) {
+		return fn(s.WithTx(tx), i)
+	}, status)
+}
+
+// WithTx returns a copy of the service whose repository runs inside tx,
+// its own units of work nest in it.
+func (s service) WithTx(tx *gorm.DB) Service {
+	s = s.withTx(tx)
+	return &s
+}
+
+func (s service) withTx(tx *gorm.DB) service {
+	s.repository = s.repository.WithTx(tx)
+	s.audit = s.audit.WithTx(tx)
+	s.uow = uow.New(tx)
+	return s
+}
+
+// WithContext returns a copy of the service bound to the request context.
+func (s service) WithContext(ctx context.Context) Service {
+	s.repository = s.repository.WithContext(ctx)
+	s.audit = s.audit.WithContext(ctx)
+	return &s
+}
+
+func NewService(
+	repository Repository,
+	logger *log.Logger,
+	phoneRegion string,
+	deletePolicy domain.DeletePolicy,
+	unitOfWork uow.UnitOfWork,
+	recorder audit.Recorder,
+) Service {
+	return &service{
+		logger:       logger,
+		repository:   repository,
+		phoneRegion:  phoneRegion,
+		deletePolicy: deletePolicy,
+		uow:          unitOfWork,
+		audit:        recorder,
+	}
+}
+
+// normalizeEmail trims the address and lowercases its domain, the local part
+// is kept as typed because it may be case sensitive.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+
+	if err != nil || address.Address != email || address.Name != "" {
+		return "", ErrInvalidEmail
+	}
+
+	_, host, _ := strings.Cut(email, "@")
+
+	if !strings.Contains(host, ".") || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") {
+		return "", ErrInvalidEmail
+	}
+
+	if utf8.RuneCountInString(email) > maxEmailLength {
+		return "", fmt.Errorf("%w, it must have at most %d characters", ErrInvalidEmail, maxEmailLength)
+	}
+
+	return domain.CanonicalEmail(email), nil
+}
+
+func normalizeEmailFilter(email string) string {
+	if normalized, err := normalizeEmail(email); err == nil {
+		return normalized
+	}
+	return strings.TrimSpace(email)
 }
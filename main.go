@@ -1,58 +1,291 @@
 package main
 
 import (
+	"cmp"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/account"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/apikey"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/audit"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/change"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/course"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/enrollment"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/imports"
+	"github.com/S3ergio31/curso-go-seccion-4/internal/search"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/user"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/body"
 	"github.com/S3ergio31/curso-go-seccion-4/pkg/bootstrap"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/cors"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/httpcache"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/idempotency"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/phone"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/ratelimit"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/requestid"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/secure"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
 func main() {
 	godotenv.Load()
-	db, err := bootstrap.DBConnection()
 	logger := bootstrap.InitLogger()
 
+	// national numbers can not be read without a region, the migrations
+	// normalize the stored ones too.
+	phoneRegion := os.Getenv("PHONE_DEFAULT_REGION")
+
+	if err := phone.CheckRegion(phoneRegion); err != nil {
+		logger.Fatalln("PHONE_DEFAULT_REGION:", err)
+	}
+
+	db, err := bootstrap.DBConnection(logger, phoneRegion)
+
 	if err != nil {
 		logger.Fatalln(err)
 	}
 
 	router := mux.NewRouter()
 
+	auditRepository := audit.NewRepository(logger, db)
+	auditService := audit.NewService(auditRepository, logger)
+	auditEndpoints := audit.MakeEndpoints(auditService)
+
+	router.HandleFunc("/audit", auditEndpoints.GetAll).Methods("GET").Name("audit.list")
+
+	userDeletePolicy, err := domain.ParseDeletePolicy(os.Getenv("USER_DELETE_POLICY"))
+
+	if err != nil {
+		logger.Fatalln("USER_DELETE_POLICY:", err)
+	}
+
+	courseDeletePolicy, err := domain.ParseDeletePolicy(os.Getenv("COURSE_DELETE_POLICY"))
+
+	if err != nil {
+		logger.Fatalln("COURSE_DELETE_POLICY:", err)
+	}
+
 	userRepository := user.NewRepository(logger, db)
-	userService := user.NewService(userRepository, logger)
+	userService := user.NewService(
+		userRepository,
+		logger,
+		phoneRegion,
+		userDeletePolicy,
+		uow.New(db),
+		auditService,
+	)
 	userEndpoints := user.MakeEndpoints(userService)
 
-	router.HandleFunc("/users", userEndpoints.Create).Methods("POST")
-	router.HandleFunc("/users", userEndpoints.GetAll).Methods("GET")
-	router.HandleFunc("/users/{id}", userEndpoints.Get).Methods("GET")
-	router.HandleFunc("/users/{id}", userEndpoints.Update).Methods("PATCH")
-	router.HandleFunc("/users/{id}", userEndpoints.Delete).Methods("DELETE")
+	router.HandleFunc("/users", userEndpoints.Create).Methods("POST").Name("users.create")
+	router.HandleFunc("/users/batch", userEndpoints.CreateBatch).Methods("POST").Name("users.create_batch")
+	router.HandleFunc("/users", userEndpoints.GetAll).Methods("GET").Name("users.list")
+	router.HandleFunc("/users/trash", userEndpoints.Trash).Methods("GET").Name("users.trash")
+	router.HandleFunc("/users/{id}", userEndpoints.Get).Methods("GET").Name("users.get")
+	router.HandleFunc("/users/{id}", userEndpoints.Update).Methods("PATCH").Name("users.update")
+	router.HandleFunc("/users/{id}", userEndpoints.Delete).Methods("DELETE").Name("users.delete")
+	router.HandleFunc("/users/{id}/restore", userEndpoints.Restore).Methods("POST").Name("users.restore")
+	router.HandleFunc("/users/{id}/purge", userEndpoints.Purge).Methods("DELETE").Name("users.purge")
 
 	courseRepository := course.NewRepository(logger, db)
-	courseService := course.NewService(courseRepository, logger)
+	courseService := course.NewService(
+		courseRepository,
+		logger,
+		courseDeletePolicy,
+		uow.New(db),
+		auditService,
+	)
 	courseEndpoints := course.MakeEndpoints(courseService)
 
-	router.HandleFunc("/courses", courseEndpoints.Create).Methods("POST")
-	router.HandleFunc("/courses", courseEndpoints.GetAll).Methods("GET")
-	router.HandleFunc("/courses/{id}", courseEndpoints.Get).Methods("GET")
-	router.HandleFunc("/courses/{id}", courseEndpoints.Update).Methods("PATCH")
-	router.HandleFunc("/courses/{id}", courseEndpoints.Delete).Methods("DELETE")
+	router.HandleFunc("/courses", courseEndpoints.Create).Methods("POST").Name("courses.create")
+	router.HandleFunc("/courses", courseEndpoints.GetAll).Methods("GET").Name("courses.list")
+	router.HandleFunc("/courses/trash", courseEndpoints.Trash).Methods("GET").Name("courses.trash")
+	router.HandleFunc("/courses/batch", courseEndpoints.UpdateBatch).Methods("PATCH").Name("courses.update_batch")
+	router.HandleFunc("/courses/{id}", courseEndpoints.Get).Methods("GET").Name("courses.get")
+	router.HandleFunc("/courses/{id}", courseEndpoints.Update).Methods("PATCH").Name("courses.update")
+	router.HandleFunc("/courses/{id}", courseEndpoints.Delete).Methods("DELETE").Name("courses.delete")
+	router.HandleFunc("/courses/{id}/restore", courseEndpoints.Restore).Methods("POST").Name("courses.restore")
+	router.HandleFunc("/courses/{id}/purge", courseEndpoints.Purge).Methods("DELETE").Name("courses.purge")
 
 	enrollmentRepository := enrollment.NewRepository(logger, db)
-	enrollmentService := enrollment.NewService(enrollmentRepository, logger, userService, courseService)
+	enrollmentService := enrollment.NewService(
+		enrollmentRepository,
+		logger,
+		userService,
+		courseService,
+		uow.New(db),
+		auditService,
+	)
 	enrollmentEndpoints := enrollment.MakeEndpoints(enrollmentService)
 
-	router.HandleFunc("/enrollments", enrollmentEndpoints.Create).Methods("POST")
+	router.HandleFunc("/enrollments", enrollmentEndpoints.Create).Methods("POST").Name("enrollments.create")
+	router.HandleFunc("/enrollments/batch", enrollmentEndpoints.CreateBatch).Methods("POST").Name("enrollments.create_batch")
+	router.HandleFunc("/enrollments", enrollmentEndpoints.GetAll).Methods("GET").Name("enrollments.list")
+	router.HandleFunc("/enrollments/{id}", enrollmentEndpoints.Get).Methods("GET").Name("enrollments.get")
+	router.HandleFunc("/enrollments/{id}", enrollmentEndpoints.Update).Methods("PATCH").Name("enrollments.update")
+
+	importRepository := imports.NewRepository(logger, db)
+	importService := imports.NewService(importRepository, logger, uow.New(db), userService, enrollmentService)
+	importEndpoints := imports.MakeEndpoints(importService)
+
+	router.HandleFunc("/imports/users", importEndpoints.Users).Methods("POST").Name("imports.users")
+	router.HandleFunc("/imports/enrollments", importEndpoints.Enrollments).Methods("POST").Name("imports.enrollments")
+	router.HandleFunc("/imports/{id}", importEndpoints.Get).Methods("GET").Name("imports.get")
+	router.HandleFunc("/imports/{id}/errors", importEndpoints.Errors).Methods("GET").Name("imports.errors")
+
+	apiKeyRepository := apikey.NewRepository(logger, db)
+	apiKeyService := apikey.NewService(apiKeyRepository, logger, os.Getenv("ADMIN_API_KEY"))
+	apiKeyEndpoints := apikey.MakeEndpoints(apiKeyService)
+
+	router.HandleFunc("/api-keys", apiKeyEndpoints.Create).Methods("POST").Name("api_keys.create")
+	router.HandleFunc("/api-keys", apiKeyEndpoints.GetAll).Methods("GET").Name("api_keys.list")
+	router.HandleFunc("/api-keys/{id}", apiKeyEndpoints.Get).Methods("GET").Name("api_keys.get")
+	router.HandleFunc("/api-keys/{id}", apiKeyEndpoints.Revoke).Methods("DELETE").Name("api_keys.revoke")
+	router.HandleFunc("/api-keys/{id}/rotate", apiKeyEndpoints.Rotate).Methods("POST").Name("api_keys.rotate")
+
+	mailer, err := bootstrap.InitMailer()
+
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	// the scopes every logged in user gets, comma separated like the keys.
+	var userScopes domain.Scopes
+	userScopes.Scan(cmp.Or(os.Getenv("USER_TOKEN_SCOPES"), "users:read,courses:read,enrollments:read"))
+
+	accountRepository := account.NewRepository(logger, db)
+	accountService := account.NewService(
+		accountRepository,
+		logger,
+		userService,
+		mailer,
+		bootstrap.EnvDuration("VERIFY_EMAIL_TOKEN_TTL", 24*time.Hour),
+		bootstrap.EnvDuration("RESET_PASSWORD_TOKEN_TTL", time.Hour),
+		bootstrap.EnvDuration("SESSION_TOKEN_TTL", 12*time.Hour),
+		userScopes,
+		uow.New(db),
+		auditService,
+	)
+	accountEndpoints := account.MakeEndpoints(accountService)
+
+	router.HandleFunc("/auth/verify-email/request", accountEndpoints.RequestVerification).Methods("POST").Name("auth.request_verification")
+	router.HandleFunc("/auth/verify-email", accountEndpoints.VerifyEmail).Methods("POST").Name("auth.verify_email")
+	router.HandleFunc("/auth/forgot-password", accountEndpoints.ForgotPassword).Methods("POST").Name("auth.forgot_password")
+	router.HandleFunc("/auth/reset-password", accountEndpoints.ResetPassword).Methods("POST").Name("auth.reset_password")
+	router.HandleFunc("/auth/login", accountEndpoints.Login).Methods("POST").Name("auth.login")
+	router.HandleFunc("/auth/logout", accountEndpoints.Logout).Methods("POST").Name("auth.logout")
+
+	changeRepository := change.NewRepository(logger, db)
+	changeService := change.NewService(changeRepository, logger)
+	changeEndpoints := change.MakeEndpoints(changeService)
+
+	router.HandleFunc("/changes", changeEndpoints.GetAll).Methods("GET").Name("changes.list")
+
+	searchRepository := search.NewRepository(logger, db)
+	searchService := search.NewService(searchRepository, logger)
+	searchEndpoints := search.MakeEndpoints(searchService)
+
+	router.HandleFunc("/search", searchEndpoints.Search).Methods("GET").Name("search.query")
+
+	router.Use(requestid.Middleware)
+
+	router.Use(httpcache.Middleware(os.Getenv("CACHE_CONTROL_DEFAULT"), httpcache.PoliciesFromEnv(router)))
+
+	proxyHops, err := ratelimit.ParseProxyHops(os.Getenv("RATE_LIMIT_PROXY_HOPS"))
+
+	if err != nil {
+		logger.Fatalln("RATE_LIMIT_PROXY_HOPS:", err)
+	}
+
+	ipLimit, err := ratelimit.ParseLimit(os.Getenv("RATE_LIMIT_IP"))
+
+	if err != nil {
+		logger.Fatalln("RATE_LIMIT_IP:", err)
+	}
+
+	// before auth, so failed authentications are limited too.
+	router.Use(ratelimit.Middleware(ratelimit.Config{
+		Store:     ratelimit.NewMemoryStore(),
+		Default:   ipLimit,
+		ProxyHops: proxyHops,
+		Logger:    logger,
+	}))
+
+	router.Use(auth.Middleware(auth.Config{
+		Authenticators: map[string]auth.Authenticator{apikey.Scheme: apiKeyService, account.Scheme: accountService},
+		Required:       os.Getenv("AUTH_REQUIRED") == "true",
+		Protected:      []string{"api_keys"},
+		Public:         []string{"auth"},
+	}))
+
+	defaultLimit, err := ratelimit.ParseLimit(os.Getenv("RATE_LIMIT_DEFAULT"))
+
+	if err != nil {
+		logger.Fatalln("RATE_LIMIT_DEFAULT:", err)
+	}
+
+	routeLimits, err := ratelimit.LimitsFromEnv(router)
+
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	router.Use(ratelimit.Middleware(ratelimit.Config{
+		Store:     ratelimit.NewMemoryStore(),
+		Default:   defaultLimit,
+		Routes:    routeLimits,
+		ProxyHops: proxyHops,
+		Logger:    logger,
+	}))
+
+	bodyLimits, err := body.ConfigFromEnv(router)
+
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	router.Use(body.Middleware(bodyLimits))
+
+	idempotencyStore := idempotency.NewStore(db)
+	idempotencyTTL := bootstrap.EnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+
+	router.Use(idempotency.Middleware(idempotency.Config{
+		Store:     idempotencyStore,
+		TTL:       idempotencyTTL,
+		Lease:     bootstrap.EnvDuration("IDEMPOTENCY_LEASE", 2*time.Minute),
+		ProxyHops: proxyHops,
+		Routes:    []string{"users.create", "users.create_batch", "courses.create", "enrollments.create", "enrollments.create_batch"},
+		Logger:    logger,
+	}))
+
+	go purgeTrash(
+		logger,
+		bootstrap.EnvDuration("TRASH_RETENTION", 30*24*time.Hour),
+		bootstrap.EnvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+		userService,
+		courseService,
+	)
+
+	go purgeTrash(logger, idempotencyTTL, bootstrap.EnvDuration("IDEMPOTENCY_PURGE_INTERVAL", time.Hour), idempotencyStore)
+
+	// preflight requests and unmatched routes never reach the router
+	// middlewares, CORS and the security headers wrap the whole router.
+	corsConfig, err := cors.ConfigFromEnv()
+
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	handler := cors.Middleware(corsConfig)(router)
+	handler = secure.Headers(bootstrap.EnvDuration("SECURITY_HSTS_MAX_AGE", 0))(handler)
 
 	server := &http.Server{
-		Handler:      router,
+		Handler:      handler,
 		Addr:         fmt.Sprintf("%s:%s", os.Getenv("APP_URL"), os.Getenv("APP_PORT")),
 		WriteTimeout: 1 * time.Minute,
 		ReadTimeout:  1 * time.Minute,
@@ -60,3 +293,22 @@ func main() {
 
 	logger.Fatal(server.ListenAndServe())
 }
+
+type trash interface {
+	PurgeExpired(retention time.Duration) (int, error)
+}
+
+// purgeTrash periodically removes the soft deleted rows older than retention,
+// and the expired idempotency keys.
+func purgeTrash(logger *log.Logger, retention, interval time.Duration, services ...trash) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		for _, s := range services {
+			if _, err := s.PurgeExpired(retention); err != nil {
+				logger.Println(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const AllScopes = "*"
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUnsupportedScheme  = errors.New("unsupported authorization scheme")
+)
+
+type Principal struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	Scopes []string `json:"scopes"`
+}
+
+func (p Principal) Can(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == AllScopes || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator resolves the credentials sent with one authorization scheme
+// (e.g. "ApiKey") into a principal.
+type Authenticator interface {
+	Authenticate(credentials string) (*Principal, error)
+}
+
+type Config struct {
+	// Authenticators are indexed by the scheme of the Authorization header,
+	// e.g. "ApiKey" for the keys and "Bearer" for the user sessions.
+	Authenticators map[string]Authenticator
+	// Required rejects anonymous requests on every route.
+	Required bool
+	// Protected lists resources that always require credentials.
+	Protected []string
+	// Public lists resources that never require nor check credentials.
+	Public []string
+}
+
+type principalKey struct{}
+
+type configKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Allowed reports whether the request of ctx may use scope: its principal
+// must hold it, an anonymous request only when the resource of the scope
+// does not require credentials. Requests that did not go through the
+// Middleware are never allowed.
+func Allowed(ctx context.Context, scope string) bool {
+	if p := FromContext(ctx); p != nil {
+		return p.Can(scope)
+	}
+
+	config, ok := ctx.Value(configKey{}).(Config)
+
+	if !ok {
+		return false
+	}
+
+	resource, _, _ := strings.Cut(scope, ":")
+
+	if contains(config.Public, resource) {
+		return true
+	}
+
+	return !config.Required && !contains(config.Protected, resource)
+}
+
+// Scope returns the scope needed to call a route, built from the resource
+// part of its name ("users.create" -> "users") and the request method.
+func Scope(routeName, method string) string {
+	resource, _, _ := strings.Cut(routeName, ".")
+
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return resource + ":read"
+	default:
+		return resource + ":write"
+	}
+}
+
+func Middleware(config Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			routeName := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				routeName = route.GetName()
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), configKey{}, config))
+
+			if contains(config.Public, routeName) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header := r.Header.Get("Authorization")
+
+			if header == "" {
+				if config.Required || contains(config.Protected, routeName) {
+					writeError(w, http.StatusUnauthorized, "authentication required")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			principal, err := config.authenticate(header)
+
+			if err != nil {
+				writeError(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+
+			if routeName != "" && !principal.Can(Scope(routeName, r.Method)) {
+				writeError(w, http.StatusForbidden, "missing scope "+Scope(routeName, r.Method))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+		})
+	}
+}
+
+func (c Config) authenticate(header string) (*Principal, error) {
+	scheme, credentials, _ := strings.Cut(header, " ")
+
+	for name, authenticator := range c.Authenticators {
+		if strings.EqualFold(name, scheme) {
+			return authenticator.Authenticate(strings.TrimSpace(credentials))
+		}
+	}
+
+	return nil, ErrUnsupportedScheme
+}
+
+// contains reports whether the resource of the route is in resources.
+func contains(resources []string, routeName string) bool {
+	resource, _, _ := strings.Cut(routeName, ".")
+
+	for _, r := range resources {
+		if r == resource {
+			return true
+		}
+	}
+	return false
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Err    string `json:"error"`
+	}{Status: status, Err: message})
+}
@@ -0,0 +1,128 @@
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/uow"
+	"gorm.io/gorm"
+)
+
+type Mode string
+
+const (
+	// Atomic applies every item or none of them.
+	Atomic Mode = "atomic"
+	// Partial applies the items that succeed and reports the others.
+	Partial Mode = "partial"
+)
+
+// MaxItems bounds the size of a batch request.
+const MaxItems = 1000
+
+var (
+	ErrInvalidMode = errors.New("mode must be atomic or partial")
+	ErrEmpty       = errors.New("items are required")
+	ErrTooMany     = fmt.Errorf("at most %d items are allowed", MaxItems)
+	ErrRolledBack  = errors.New("not applied, another item of the batch failed")
+)
+
+// Result is the outcome of one item, Index is its position in the request.
+type Result struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+	Data   any    `json:"data,omitempty"`
+	Err    string `json:"error,omitempty"`
+}
+
+// ParseMode defaults to Atomic.
+func ParseMode(raw string) (Mode, error) {
+	switch Mode(raw) {
+	case "", Atomic:
+		return Atomic, nil
+	case Partial:
+		return Partial, nil
+	default:
+		return "", ErrInvalidMode
+	}
+}
+
+// Check validates the size of a batch.
+func Check(n int) error {
+	if n == 0 {
+		return ErrEmpty
+	}
+	if n > MaxItems {
+		return ErrTooMany
+	}
+	return nil
+}
+
+// Run calls fn for the n items of a batch in one transaction, each item in
+// its own savepoint so a failure only undoes that item. In atomic mode any
+// failure rolls the whole batch back and the items that had succeeded are
+// reported with ErrRolledBack. fn returns the id and the data of the item,
+// status maps its errors to HTTP codes.
+func Run(u uow.UnitOfWork, mode Mode, n int, fn func(tx *gorm.DB, i int) (string, any, error), status func(error) int) ([]Result, error) {
+	results := make([]Result, n)
+	failed := false
+
+	err := u.Do(func(tx *gorm.DB) error {
+		for i := range results {
+			var (
+				id   string
+				data any
+			)
+
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				id, data, err = fn(tx, i)
+				return err
+			})
+
+			results[i] = Result{Index: i, Status: http.StatusOK, ID: id, Data: data}
+
+			if err != nil {
+				failed = true
+				results[i] = Result{Index: i, Status: status(err), Err: err.Error()}
+			}
+		}
+
+		if failed && mode == Atomic {
+			return ErrRolledBack
+		}
+		return nil
+	})
+
+	if err != nil && !errors.Is(err, ErrRolledBack) {
+		return nil, err
+	}
+
+	if errors.Is(err, ErrRolledBack) {
+		for i, result := range results {
+			if result.Err == "" {
+				results[i] = Result{Index: i, Status: http.StatusFailedDependency, Err: ErrRolledBack.Error()}
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// Status is the code of the whole batch: 200 when every item succeeded,
+// 207 when a partial batch was only applied in part and 422 when an atomic
+// batch was rolled back.
+func Status(mode Mode, results []Result) int {
+	for _, result := range results {
+		if result.Err == "" {
+			continue
+		}
+		if mode == Atomic {
+			return http.StatusUnprocessableEntity
+		}
+		return http.StatusMultiStatus
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,177 @@
+package body
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultLimit applies when BODY_LIMIT_DEFAULT is not set.
+const defaultLimit = 1 << 20
+
+var (
+	ErrInvalid              = errors.New("invalid request format")
+	ErrTooLarge             = errors.New("request body is too large")
+	ErrUnsupportedMediaType = errors.New("content type must be application/json")
+	ErrInvalidSize          = errors.New("invalid size, use a number of bytes with an optional KB, MB or GB unit")
+)
+
+// units are the multipliers of the sizes accepted by ParseSize.
+var units = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// Decode reads the JSON body of r into v. The body must be sent as
+// application/json, hold a single value and no field unknown to v.
+func Decode(r *http.Request, v any) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return ErrUnsupportedMediaType
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(v)
+
+	if err == nil {
+		if _, err = decoder.Token(); err == io.EOF {
+			return nil
+		}
+	}
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		return ErrTooLarge
+	}
+
+	// the decoder reports unknown fields as `json: unknown field "name"`.
+	if field, ok := strings.CutPrefix(fmt.Sprint(err), "json: unknown field "); ok {
+		return fmt.Errorf("%w: unknown field %s", ErrInvalid, field)
+	}
+
+	return ErrInvalid
+}
+
+// Status is the HTTP status matching a Decode error.
+func Status(err error) int {
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// ParseSize reads a size in bytes, "512", "64KB" or "10MB".
+func ParseSize(raw string) (int64, error) {
+	raw = strings.ToUpper(strings.TrimSpace(raw))
+	multiplier := int64(1)
+
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(raw, unit.suffix); ok {
+			raw, multiplier = strings.TrimSpace(number), unit.bytes
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(raw, 10, 64)
+
+	if err != nil || n <= 0 {
+		return 0, ErrInvalidSize
+	}
+	return n * multiplier, nil
+}
+
+type Config struct {
+	// Default applies to the routes without their own limit.
+	Default int64
+	// Routes are the limits indexed by route name.
+	Routes map[string]int64
+}
+
+// ConfigFromEnv reads the default limit from BODY_LIMIT_DEFAULT, 1MB when
+// not set, and the limit of every named route from BODY_LIMIT_<ROUTE NAME>,
+// e.g. BODY_LIMIT_IMPORTS_USERS for "imports.users".
+func ConfigFromEnv(router *mux.Router) (Config, error) {
+	config := Config{Default: defaultLimit, Routes: make(map[string]int64)}
+
+	if raw, ok := os.LookupEnv("BODY_LIMIT_DEFAULT"); ok {
+		size, err := ParseSize(raw)
+
+		if err != nil {
+			return config, fmt.Errorf("BODY_LIMIT_DEFAULT: %w", err)
+		}
+		config.Default = size
+	}
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		name := route.GetName()
+		key := "BODY_LIMIT_" + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+
+		if raw, ok := os.LookupEnv(key); ok && name != "" {
+			size, err := ParseSize(raw)
+
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			config.Routes[name] = size
+		}
+		return nil
+	})
+
+	return config, err
+}
+
+// Middleware caps the size of request bodies with http.MaxBytesReader.
+// Bodies announcing a larger Content-Length are rejected with 413 right
+// away, the others fail when reading past the limit.
+func Middleware(config Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit := config.Default
+
+			if route := mux.CurrentRoute(r); route != nil {
+				if l, ok := config.Routes[route.GetName()]; ok {
+					limit = l
+				}
+			}
+
+			if r.ContentLength > limit {
+				writeError(w, http.StatusRequestEntityTooLarge, ErrTooLarge.Error())
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Err    string `json:"error"`
+	}{Status: status, Err: message})
+}
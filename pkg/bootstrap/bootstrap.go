@@ -1,20 +1,82 @@
 package bootstrap
 
 import (
+	"cmp"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/S3ergio31/curso-go-seccion-4/internal/audit"
 	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/fulltext"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/mailer"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/phone"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func InitLogger() *log.Logger {
 	return log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
 }
 
-func DBConnection() (*gorm.DB, error) {
+// InitMailer picks the mailer from MAILER_DRIVER: "smtp" delivers mails,
+// "file" appends them to MAILER_FILE and anything else writes them to stdout.
+func InitMailer() (mailer.Mailer, error) {
+	from := os.Getenv("MAILER_FROM")
+
+	switch os.Getenv("MAILER_DRIVER") {
+	case "smtp":
+		return mailer.NewSMTP(
+			os.Getenv("SMTP_HOST"),
+			os.Getenv("SMTP_PORT"),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			from,
+		), nil
+	case "file":
+		file, err := os.OpenFile(os.Getenv("MAILER_FILE"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return mailer.NewWriter(file, from), nil
+	default:
+		return mailer.NewWriter(os.Stdout, from), nil
+	}
+}
+
+// EnvDuration reads a time.ParseDuration value ("15m", "24h") from the
+// environment, falling back when it is missing or invalid.
+func EnvDuration(key string, fallback time.Duration) time.Duration {
+	duration, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || duration <= 0 {
+		return fallback
+	}
+	return duration
+}
+
+// DBConnection opens the database and migrates it when DATABASE_MIGRATE is
+// set, phoneRegion reads the national numbers stored before normalization.
+func DBConnection(logger *log.Logger, phoneRegion string) (*gorm.DB, error) {
+	db, err := OpenDB()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("DATABASE_MIGRATE") == "true" {
+		if err := Migrate(db, logger, phoneRegion); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+// OpenDB connects to the database without running the migrations.
+func OpenDB() (*gorm.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@(%s:%s)/%s?charset=utf8&parseTime=True&loc=Local",
 		os.Getenv("DATABASE_USER"),
 		os.Getenv("DATABASE_PASSWORD"),
@@ -23,7 +85,7 @@ func DBConnection() (*gorm.DB, error) {
 		os.Getenv("DATABASE_NAME"),
 	)
 
-	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
 
 	if err != nil {
 		return nil, err
@@ -33,11 +95,288 @@ func DBConnection() (*gorm.DB, error) {
 		db = db.Debug()
 	}
 
-	if os.Getenv("DATABASE_MIGRATE") == "true" {
-		if err := db.AutoMigrate(&domain.User{}, &domain.Course{}, &domain.Enrollment{}); err != nil {
-			return nil, err
+	return db, nil
+}
+
+// models are the tables created by Migrate.
+var models = []any{
+	&domain.User{},
+	&domain.Course{},
+	&domain.Enrollment{},
+	&domain.APIKey{},
+	&domain.UserToken{},
+	&domain.AuditLog{},
+	&domain.ImportJob{},
+	&domain.ImportError{},
+	&domain.IdempotencyKey{},
+	&domain.ChangeEvent{},
+}
+
+// Migrate creates the tables and their foreign keys. Enrollments restrict
+// the deletion of their user and course, purges remove them explicitly. On
+// MySQL tables are created as InnoDB, the engine enforcing foreign keys, and
+// existing tables are converted first, see enforceForeignKeys; existing
+// orphan enrollments make the constraint creation fail, see
+// cmd/check-integrity. The rows rewritten by the migrations are audited like
+// any other change.
+func Migrate(db *gorm.DB, logger *log.Logger, phoneRegion string) error {
+	// the change feed starts with a snapshot of the rows written before it.
+	seedChanges := !db.Migrator().HasTable(&domain.ChangeEvent{})
+
+	// legacy databases may not have the tables of the audit yet.
+	if err := db.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(&domain.AuditLog{}, &domain.ChangeEvent{}); err != nil {
+		return err
+	}
+
+	// the snapshot is taken before the rewrites below, which follow it in
+	// the feed as updates.
+	if seedChanges {
+		err := seed(db, "course", func(c domain.Course) (string, *time.Time, bool) { return c.ID, c.UpdatedAt, c.Deleted.Valid })
+
+		if err == nil {
+			err = seed(db, "enrollment", func(e domain.Enrollment) (string, *time.Time, bool) { return e.ID, e.UpdatedAt, e.Deleted.Valid })
+		}
+
+		if err == nil {
+			err = seed(db, "user", func(u domain.User) (string, *time.Time, bool) { return u.ID, u.UpdatedAt, u.Deleted.Valid })
+		}
+
+		if err != nil {
+			return err
 		}
 	}
 
-	return db, nil
+	recorder := audit.NewService(audit.NewRepository(logger, db), logger)
+
+	if err := normalizeEmails(db, recorder); err != nil {
+		return err
+	}
+
+	if err := enforceForeignKeys(db); err != nil {
+		return err
+	}
+
+	if err := db.Set("gorm:table_options", "ENGINE=InnoDB").AutoMigrate(models...); err != nil {
+		return err
+	}
+
+	if err := backfillPhones(db, recorder, phoneRegion); err != nil {
+		return err
+	}
+
+	for _, index := range []fulltext.Index{domain.UserSearch, domain.CourseSearch} {
+		if err := index.Migrate(db); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enforceForeignKeys prepares the MySQL tables created before the foreign
+// keys: table options only apply to new tables, so other engines are
+// converted to InnoDB, and enrollment constraints with another delete rule
+// are dropped for AutoMigrate to create them again as RESTRICT.
+func enforceForeignKeys(db *gorm.DB) error {
+	if db.Dialector.Name() != "mysql" {
+		return nil
+	}
+
+	tables := make([]string, 0, len(models))
+
+	for _, model := range models {
+		stmt := &gorm.Statement{DB: db}
+
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+
+		tables = append(tables, stmt.Schema.Table)
+	}
+
+	var convert []string
+
+	err := db.Raw(`SELECT TABLE_NAME FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME IN ? AND ENGINE <> 'InnoDB'`, tables).
+		Scan(&convert).Error
+
+	if err != nil {
+		return err
+	}
+
+	for _, table := range convert {
+		if err := db.Exec("ALTER TABLE ? ENGINE=InnoDB", clause.Table{Name: table}).Error; err != nil {
+			return err
+		}
+	}
+
+	var constraints []string
+
+	err = db.Raw(`SELECT CONSTRAINT_NAME FROM information_schema.REFERENTIAL_CONSTRAINTS
+		WHERE CONSTRAINT_SCHEMA = DATABASE() AND TABLE_NAME = ? AND DELETE_RULE <> 'RESTRICT'`,
+		db.NamingStrategy.TableName("Enrollment")).
+		Scan(&constraints).Error
+
+	if err != nil {
+		return err
+	}
+
+	for _, name := range constraints {
+		if err := db.Migrator().DropConstraint(&domain.Enrollment{}, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seed writes a change event with the current state of every row of T,
+// trashed rows are deleted events.
+func seed[T any](db *gorm.DB, entity string, row func(T) (id string, updatedAt *time.Time, deleted bool)) error {
+	var rows []T
+
+	if !db.Migrator().HasTable(new(T)) {
+		return nil
+	}
+
+	return db.Unscoped().FindInBatches(&rows, 500, func(tx *gorm.DB, _ int) error {
+		events := make([]*domain.ChangeEvent, 0, len(rows))
+
+		for _, r := range rows {
+			id, updatedAt, deleted := row(r)
+			action := domain.ChangeCreated
+
+			if deleted {
+				action = domain.ChangeDeleted
+			}
+
+			event, err := domain.NewChangeEvent(entity, id, action, r)
+
+			if err != nil {
+				return err
+			}
+
+			if updatedAt != nil {
+				event.ChangedAt = *updatedAt
+			}
+
+			events = append(events, event)
+		}
+
+		return db.Create(events).Error
+	}).Error
+}
+
+// normalizeEmails brings the emails stored before they were normalized to
+// their canonical form and frees the duplicates, so the unique index can be
+// created. The oldest active user keeps an address, the others, trashed ones
+// included, get <id>@duplicate.invalid, audited with the original address.
+// It only runs until the index exists, the service keeps the emails
+// normalized afterwards.
+func normalizeEmails(db *gorm.DB, recorder audit.Recorder) error {
+	if !db.Migrator().HasTable(&domain.User{}) || db.Migrator().HasIndex(&domain.User{}, "Email") {
+		return nil
+	}
+
+	var users []domain.User
+
+	err := db.Unscoped().Select("id", "email").
+		Order("deleted IS NOT NULL, created_at, id").
+		Find(&users).Error
+
+	if err != nil {
+		return err
+	}
+
+	// tables older than the version column get it from AutoMigrate.
+	versioned := db.Migrator().HasColumn(&domain.User{}, "Version")
+
+	// addresses are compared case insensitively, as the MySQL collation does.
+	seen := make(map[string]bool, len(users))
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		recorder := recorder.WithTx(tx)
+
+		for _, user := range users {
+			email := domain.CanonicalEmail(user.Email)
+
+			if seen[strings.ToLower(email)] {
+				email = strings.ReplaceAll(user.ID, "-", "") + "@duplicate.invalid"
+			}
+
+			seen[strings.ToLower(email)] = true
+
+			if email == user.Email {
+				continue
+			}
+
+			values := map[string]any{"email": email}
+
+			if versioned {
+				values["version"] = gorm.Expr("version + 1")
+			}
+
+			if err := rewriteUser(tx, recorder, user.ID, values); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rewriteUser updates the columns of a user, trashed ones included, without
+// touching updated_at and audits the change with recorder, bound to tx.
+func rewriteUser(tx *gorm.DB, recorder audit.Recorder, id string, values map[string]any) error {
+	var before, after domain.User
+
+	if err := tx.Unscoped().First(&before, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Unscoped().Model(&domain.User{}).Where("id = ?", id).UpdateColumns(values).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Unscoped().First(&after, "id = ?", id).Error; err != nil {
+		return err
+	}
+
+	return recorder.Record("user", id, audit.ActionUpdate, &before, &after)
+}
+
+// backfillPhones fills the phone_display column of the users stored before
+// phones were normalized with their original number, and stores the number
+// in E.164. Numbers that can not be normalized are left untouched, with an
+// empty phone_display, so a later run with the right region retries them.
+// Numbers left national by earlier runs, which filled phone_display anyway,
+// are retried as well. Each batch is rewritten and audited in a transaction.
+func backfillPhones(db *gorm.DB, recorder audit.Recorder, region string) error {
+	var users []domain.User
+
+	return db.Unscoped().Select("id", "phone", "phone_display").
+		Where("phone <> '' AND (phone_display = '' OR phone NOT LIKE '+%')").
+		FindInBatches(&users, 500, func(_ *gorm.DB, _ int) error {
+			return db.Transaction(func(tx *gorm.DB) error {
+				recorder := recorder.WithTx(tx)
+
+				for _, user := range users {
+					normalized, err := phone.Normalize(user.Phone, region)
+
+					if err != nil {
+						continue
+					}
+
+					values := map[string]any{
+						"phone":         normalized,
+						"phone_display": cmp.Or(user.PhoneDisplay, user.Phone),
+						"version":       gorm.Expr("version + 1"),
+					}
+
+					if err := rewriteUser(tx, recorder, user.ID, values); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}).Error
 }
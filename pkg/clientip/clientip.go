@@ -0,0 +1,31 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// FromRequest returns the IP of the client. Behind proxyHops trusted proxies
+// it is the hop the outermost one added to X-Forwarded-For, counted from the
+// right; the hops on its left are sent by the client and ignored. Requests
+// with less hops did not go through the proxies and are identified by their
+// address, as every request when proxyHops is 0.
+func FromRequest(r *http.Request, proxyHops int) string {
+	if proxyHops > 0 {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+		if len(hops) >= proxyHops {
+			if hop := strings.TrimSpace(hops[len(hops)-proxyHops]); hop != "" {
+				return hop
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,171 @@
+package cors
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMethods = "GET, POST, PATCH, DELETE"
+	defaultHeaders = "Authorization, Content-Type, If-Match, If-None-Match, Idempotency-Key, X-Request-ID"
+	// defaultExposed are the response headers the API clients rely on.
+	defaultExposed = "ETag, Last-Modified, Location, Link, Content-Disposition, X-Request-ID, Idempotent-Replayed, " +
+		"RateLimit-Policy, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After, X-Export-Truncated"
+	defaultMaxAge = 10 * time.Minute
+)
+
+var ErrWildcardCredentials = errors.New("CORS_ALLOWED_ORIGINS=* can not be used with CORS_ALLOW_CREDENTIALS, list the origins")
+
+type Config struct {
+	// AllowedOrigins are the origins allowed to call the API, "*" allows any
+	// without credentials. No origin disables CORS.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and Authorization headers.
+	AllowCredentials bool
+	// MaxAge is how long browsers cache the answer to a preflight request.
+	MaxAge time.Duration
+}
+
+// ConfigFromEnv reads the comma separated CORS_ALLOWED_ORIGINS,
+// CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS and CORS_EXPOSED_HEADERS, plus
+// CORS_ALLOW_CREDENTIALS and CORS_MAX_AGE ("10m"). Credentials require the
+// origins to be listed, any site could read the responses of a logged in user
+// otherwise.
+func ConfigFromEnv() (Config, error) {
+	maxAge, err := time.ParseDuration(os.Getenv("CORS_MAX_AGE"))
+
+	if err != nil || maxAge < 0 {
+		maxAge = defaultMaxAge
+	}
+
+	config := Config{
+		AllowedOrigins:   list(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		AllowedMethods:   list(env("CORS_ALLOWED_METHODS", defaultMethods)),
+		AllowedHeaders:   list(env("CORS_ALLOWED_HEADERS", defaultHeaders)),
+		ExposedHeaders:   list(env("CORS_EXPOSED_HEADERS", defaultExposed)),
+		AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+		MaxAge:           maxAge,
+	}
+
+	if config.AllowCredentials && slices.Contains(config.AllowedOrigins, "*") {
+		return Config{}, ErrWildcardCredentials
+	}
+	return config, nil
+}
+
+// Middleware answers the preflight requests of allowed origins and adds the
+// CORS headers to their responses. It wraps the router, preflight requests
+// do not match any route. Requests from other origins get no CORS headers,
+// so browsers block them, and their preflight a 403.
+func Middleware(config Config) func(http.Handler) http.Handler {
+	methods := strings.Join(config.AllowedMethods, ", ")
+	exposed := strings.Join(config.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(config.MaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if origin == "" || len(config.AllowedOrigins) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+
+			if !config.allows(origin) {
+				if preflight {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", config.allowOrigin(origin))
+
+			if config.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if !preflight {
+				if exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", exposed)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+			if !contains(config.AllowedMethods, r.Header.Get("Access-Control-Request-Method")) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			requested := list(r.Header.Get("Access-Control-Request-Headers"))
+
+			for _, header := range requested {
+				if !contains(config.AllowedHeaders, header) {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+
+			if len(requested) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+			}
+
+			w.Header().Set("Access-Control-Max-Age", maxAge)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+func (c Config) allows(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, "*") || slices.Contains(c.AllowedOrigins, origin)
+}
+
+// allowOrigin echoes the listed origins. Any origin gets "*", which browsers
+// never combine with credentials.
+func (c Config) allowOrigin(origin string) string {
+	if slices.Contains(c.AllowedOrigins, "*") {
+		return "*"
+	}
+	return origin
+}
+
+// contains compares header names and methods case insensitively.
+func contains(values []string, value string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, value) })
+}
+
+func list(raw string) []string {
+	var values []string
+
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func env(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,88 @@
+package etag
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPreconditionRequired = errors.New("If-Match header is required")
+	ErrPreconditionFailed   = errors.New("If-Match header does not match any version")
+)
+
+// Version returns the entity tag of a resource version. Every write to a
+// resource, its restore and verification included, bumps the version, or
+// clients would revalidate stale copies.
+func Version(version int) string {
+	return `"v` + strconv.Itoa(version) + `"`
+}
+
+// Required tells whether writes must name the version they modify, it reads
+// IF_MATCH_REQUIRED ("true") once.
+var Required = sync.OnceValue(func() bool {
+	return os.Getenv("IF_MATCH_REQUIRED") == "true"
+})
+
+// IfMatch returns the version the client expects to modify, nil means any
+// version ("*" or no header when not Required). If-Match uses the strong
+// comparison, weak tags never match.
+func IfMatch(r *http.Request) (*int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+
+	if header == "" {
+		if Required() {
+			return nil, ErrPreconditionRequired
+		}
+		return nil, nil
+	}
+
+	if header == "*" {
+		return nil, nil
+	}
+
+	// several tags would mean several acceptable versions, only one is
+	// supported by the repositories
+	if !strings.HasPrefix(header, `"v`) || !strings.HasSuffix(header, `"`) || len(header) < 4 {
+		return nil, ErrPreconditionFailed
+	}
+
+	version, err := strconv.Atoi(header[2 : len(header)-1])
+
+	if err != nil {
+		return nil, ErrPreconditionFailed
+	}
+
+	return &version, nil
+}
+
+// Require checks a version sent in a request body, where IfMatch can not be
+// used (batches): it is only mandatory when Required.
+func Require(version *int) error {
+	if version == nil && Required() {
+		return ErrPreconditionRequired
+	}
+	return nil
+}
+
+// WhereVersion restricts a write to the version the client read, nil
+// accepts any version.
+func WhereVersion(tx *gorm.DB, version *int) *gorm.DB {
+	if version == nil {
+		return tx
+	}
+	return tx.Where("version = ?", *version)
+}
+
+// Status maps the If-Match errors to their HTTP status code.
+func Status(err error) int {
+	if errors.Is(err, ErrPreconditionRequired) {
+		return http.StatusPreconditionRequired
+	}
+	return http.StatusPreconditionFailed
+}
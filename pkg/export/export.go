@@ -0,0 +1,201 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Format string
+
+const (
+	CSV    Format = "csv"
+	NDJSON Format = "ndjson"
+	XLSX   Format = "xlsx"
+)
+
+const (
+	// defaultMaxRows caps the rows of an export when EXPORT_MAX_ROWS is not set.
+	defaultMaxRows = 100000
+	// defaultWriteTimeout replaces the server write timeout for exports when
+	// EXPORT_WRITE_TIMEOUT is not set.
+	defaultWriteTimeout = 10 * time.Minute
+	// TruncatedHeader is set to the number of rows matching an export that
+	// was capped at MaxRows.
+	TruncatedHeader = "X-Export-Truncated"
+)
+
+// ErrTruncated is returned when the export failed after its first bytes
+// were sent, the client gets a truncated file.
+var ErrTruncated = errors.New("export truncated")
+
+var mediaTypes = map[string]Format{
+	"text/csv":             CSV,
+	"application/x-ndjson": NDJSON,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": XLSX,
+}
+
+// Negotiate picks the export format from the format parameter or the Accept
+// header, it reports false for regular JSON requests. The response is marked
+// as varying with Accept either way.
+func Negotiate(w http.ResponseWriter, r *http.Request) (Format, bool) {
+	w.Header().Add("Vary", "Accept")
+
+	switch f := Format(r.URL.Query().Get("format")); f {
+	case CSV, NDJSON, XLSX:
+		return f, true
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+
+		if f, ok := mediaTypes[mediaType]; ok {
+			return f, true
+		}
+	}
+
+	return "", false
+}
+
+// MaxRows is the most rows an export returns, from EXPORT_MAX_ROWS.
+func MaxRows() int {
+	if max, err := strconv.Atoi(os.Getenv("EXPORT_MAX_ROWS")); err == nil && max > 0 {
+		return max
+	}
+	return defaultMaxRows
+}
+
+// Limit returns the rows an export may read, MaxRows, and sets the
+// TruncatedHeader when count, the rows matching the export, is over it.
+func Limit(w http.ResponseWriter, count func() (int, error)) (int, error) {
+	max := MaxRows()
+	total, err := count()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if total > max {
+		w.Header().Set(TruncatedHeader, strconv.Itoa(total))
+	}
+	return max, nil
+}
+
+// WriteTimeout is how long an export may take to be sent, from
+// EXPORT_WRITE_TIMEOUT; large exports outlast the server write timeout.
+func WriteTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("EXPORT_WRITE_TIMEOUT")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return defaultWriteTimeout
+}
+
+// Stream sends the rows produced by each as an attachment named after name.
+// Rows are converted to JSON and their columns picked by name, nested
+// objects end up as JSON text in CSV and XLSX cells. It returns a plain
+// error while nothing was sent, so the caller can still answer with an
+// error, and ErrTruncated afterwards.
+func Stream(w http.ResponseWriter, format Format, name string, columns []string, each func(write func(row any) error) error) error {
+	// writers that can not extend the deadline keep the server one.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(WriteTimeout()))
+
+	out := &lazy{w: w, format: format, name: name}
+
+	var writer rowWriter
+
+	switch format {
+	case CSV:
+		writer = newCSV(out, columns)
+	case XLSX:
+		writer = newXLSX(out, columns)
+	default:
+		writer = newNDJSON(out, columns)
+	}
+
+	err := each(func(row any) error {
+		raw, err := json.Marshal(row)
+
+		if err != nil {
+			return err
+		}
+
+		var object map[string]json.RawMessage
+
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return err
+		}
+
+		return writer.Write(object)
+	})
+
+	if err == nil {
+		err = writer.Close()
+	}
+
+	if err != nil && out.started {
+		return errors.Join(ErrTruncated, err)
+	}
+
+	return err
+}
+
+type rowWriter interface {
+	Write(object map[string]json.RawMessage) error
+	Close() error
+}
+
+// lazy sets the headers of the download on its first write.
+type lazy struct {
+	w       http.ResponseWriter
+	format  Format
+	name    string
+	started bool
+}
+
+func (l *lazy) Write(p []byte) (int, error) {
+	if !l.started {
+		l.started = true
+
+		for mediaType, format := range mediaTypes {
+			if format == l.format {
+				l.w.Header().Set("Content-Type", mediaType)
+			}
+		}
+
+		l.w.Header().Set("Content-Disposition", `attachment; filename="`+l.name+"."+string(l.format)+`"`)
+	}
+	return l.w.Write(p)
+}
+
+// cell is the value of a column: text, or a number kept as such in XLSX.
+type cell struct {
+	text   string
+	number bool
+}
+
+func cellOf(raw json.RawMessage) cell {
+	raw = bytes.TrimSpace(raw)
+
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		return cell{}
+	case raw[0] == '"':
+		var s string
+		json.Unmarshal(raw, &s)
+		return cell{text: s}
+	case raw[0] == '-' || (raw[0] >= '0' && raw[0] <= '9'):
+		return cell{text: string(raw), number: true}
+	default:
+		return cell{text: string(raw)}
+	}
+}
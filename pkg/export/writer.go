@@ -0,0 +1,112 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	// bom lets spreadsheets detect UTF-8 when opening the CSV files.
+	bom = "\ufeff"
+	// flushEvery is the number of rows buffered before they are sent.
+	flushEvery = 100
+)
+
+type csvWriter struct {
+	w       io.Writer
+	csv     *csv.Writer
+	columns []string
+	rows    int
+}
+
+func newCSV(w io.Writer, columns []string) *csvWriter {
+	return &csvWriter{w: w, csv: csv.NewWriter(w), columns: columns}
+}
+
+func (c *csvWriter) Write(object map[string]json.RawMessage) error {
+	if c.rows == 0 {
+		if err := c.header(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(c.columns))
+
+	for n, column := range c.columns {
+		record[n] = sanitize(cellOf(object[column]))
+	}
+
+	c.rows++
+
+	if err := c.csv.Write(record); err != nil {
+		return err
+	}
+
+	// rows are sent as they come instead of being buffered by the writer.
+	if c.rows%flushEvery == 0 {
+		c.csv.Flush()
+	}
+	return c.csv.Error()
+}
+
+func (c *csvWriter) Close() error {
+	if c.rows == 0 {
+		if err := c.header(); err != nil {
+			return err
+		}
+	}
+
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+func (c *csvWriter) header() error {
+	if _, err := io.WriteString(c.w, bom); err != nil {
+		return err
+	}
+	return c.csv.Write(c.columns)
+}
+
+// sanitize prevents formula injection when the file is opened in a
+// spreadsheet: text starting like a formula gets a leading quote. Signed
+// numbers, as phones, are kept.
+func sanitize(c cell) string {
+	if c.number || c.text == "" {
+		return c.text
+	}
+
+	switch c.text[0] {
+	case '=', '@', '\t', '\r':
+		return "'" + c.text
+	case '+', '-':
+		if strings.Trim(c.text[1:], "0123456789 ") != "" {
+			return "'" + c.text
+		}
+	}
+	return c.text
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+	columns []string
+}
+
+func newNDJSON(w io.Writer, columns []string) *ndjsonWriter {
+	return &ndjsonWriter{encoder: json.NewEncoder(w), columns: columns}
+}
+
+func (n *ndjsonWriter) Write(object map[string]json.RawMessage) error {
+	for name := range object {
+		if !slices.Contains(n.columns, name) {
+			delete(object, name)
+		}
+	}
+	return n.encoder.Encode(object)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+)
+
+// parts are the minimal package of a workbook with a single sheet, the
+// sheet itself is streamed with inline strings so no shared strings table
+// has to be kept in memory.
+var parts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Export" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+type xlsxWriter struct {
+	w       io.Writer
+	zip     *zip.Writer
+	sheet   *bufio.Writer
+	columns []string
+	rows    int
+}
+
+func newXLSX(w io.Writer, columns []string) *xlsxWriter {
+	return &xlsxWriter{w: w, columns: columns}
+}
+
+func (x *xlsxWriter) Write(object map[string]json.RawMessage) error {
+	if x.sheet == nil {
+		if err := x.open(); err != nil {
+			return err
+		}
+	}
+
+	cells := make([]cell, len(x.columns))
+
+	for n, column := range x.columns {
+		cells[n] = cellOf(object[column])
+	}
+
+	x.rows++
+
+	if err := x.row(cells); err != nil {
+		return err
+	}
+
+	if x.rows%flushEvery == 0 {
+		return x.sheet.Flush()
+	}
+	return nil
+}
+
+func (x *xlsxWriter) Close() error {
+	if x.sheet == nil {
+		if err := x.open(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := x.sheet.WriteString(`</sheetData></worksheet>`); err != nil {
+		return err
+	}
+
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
+
+// open writes the fixed parts and the start of the sheet, with the columns
+// as its first row.
+func (x *xlsxWriter) open() error {
+	x.zip = zip.NewWriter(x.w)
+
+	for _, part := range parts {
+		f, err := x.zip.Create(part.name)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+
+	f, err := x.zip.Create("xl/worksheets/sheet1.xml")
+
+	if err != nil {
+		return err
+	}
+
+	x.sheet = bufio.NewWriter(f)
+	x.sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	header := make([]cell, len(x.columns))
+
+	for n, column := range x.columns {
+		header[n] = cell{text: column}
+	}
+
+	return x.row(header)
+}
+
+func (x *xlsxWriter) row(cells []cell) error {
+	x.sheet.WriteString("<row>")
+
+	for _, c := range cells {
+		switch {
+		case c.text == "":
+			x.sheet.WriteString("<c/>")
+		case c.number:
+			x.sheet.WriteString("<c><v>" + c.text + "</v></c>")
+		default:
+			x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(x.sheet, []byte(c.text))
+			x.sheet.WriteString("</t></is></c>")
+		}
+	}
+
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
@@ -0,0 +1,119 @@
+package fields
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// always is returned even when it is not requested.
+const always = "id"
+
+var ErrInvalid = errors.New("invalid parameter")
+
+// Parse reads a comma separated list of fields ("id,name"), checked against
+// the allowed ones. An empty list means every field.
+func Parse(raw string, allowed []string) ([]string, error) {
+	return parse("fields", raw, allowed)
+}
+
+// ParseInclude reads the comma separated relations of an include parameter.
+func ParseInclude(raw string, allowed []string) ([]string, error) {
+	return parse("include", raw, allowed)
+}
+
+// Select returns v, a struct or a slice of structs, as JSON objects holding
+// only the given fields. v is returned as it is when fields is empty.
+func Select(v any, fields []string) (any, error) {
+	if len(fields) == 0 {
+		return v, nil
+	}
+
+	raw, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) > 0 && raw[0] == '[' {
+		var objects []map[string]json.RawMessage
+
+		if err := json.Unmarshal(raw, &objects); err != nil {
+			return nil, err
+		}
+
+		for n, object := range objects {
+			objects[n] = keep(object, fields)
+		}
+		return objects, nil
+	}
+
+	var object map[string]json.RawMessage
+
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+
+	return keep(object, fields), nil
+}
+
+// Implied adds to include the relations named in fields, a relation is
+// only set once it is loaded, so selecting it implies including it.
+func Implied(include, fields, relations []string) []string {
+	for _, field := range fields {
+		if slices.Contains(relations, field) && !slices.Contains(include, field) {
+			include = append(include, field)
+		}
+	}
+	return include
+}
+
+// Columns lists the fields of a tabular output: the selected ones, or every
+// allowed field when none is, with id always first.
+func Columns(fields, allowed []string) []string {
+	if len(fields) == 0 {
+		fields = allowed
+	}
+
+	columns := []string{always}
+
+	for _, field := range fields {
+		if field != always {
+			columns = append(columns, field)
+		}
+	}
+	return columns
+}
+
+func parse(param, raw string, allowed []string) ([]string, error) {
+	var names []string
+
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		if !slices.Contains(allowed, name) {
+			return nil, fmt.Errorf("%w: %s %q is not allowed, use %s", ErrInvalid, param, name, strings.Join(allowed, ", "))
+		}
+
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+func keep(object map[string]json.RawMessage, fields []string) map[string]json.RawMessage {
+	for name := range object {
+		if name != always && !slices.Contains(fields, name) {
+			delete(object, name)
+		}
+	}
+	return object
+}
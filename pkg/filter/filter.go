@@ -0,0 +1,220 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Operator string
+
+const (
+	Eq       Operator = "eq"
+	Ne       Operator = "ne"
+	Gt       Operator = "gt"
+	Gte      Operator = "gte"
+	Lt       Operator = "lt"
+	Lte      Operator = "lte"
+	In       Operator = "in"
+	Contains Operator = "contains"
+	IsNull   Operator = "is_null"
+)
+
+type Kind int
+
+const (
+	String Kind = iota
+	Time
+	Int
+)
+
+// maxValues bounds the list of an "in" condition.
+const maxValues = 100
+
+var ErrInvalid = errors.New("invalid filter")
+
+// operators are the operators accepted by each kind of field.
+var operators = map[Kind][]Operator{
+	String: {Eq, Ne, In, Contains, IsNull},
+	Time:   {Eq, Ne, Gt, Gte, Lt, Lte, In, IsNull},
+	Int:    {Eq, Ne, Gt, Gte, Lt, Lte, In, IsNull},
+}
+
+// key matches "filter[field]" and "filter[field][operator]".
+var key = regexp.MustCompile(`^filter\[([a-z_]+)\](?:\[([a-z_]+)\])?$`)
+
+// Field describes a filterable field of a resource.
+type Field struct {
+	Column string
+	Kind   Kind
+}
+
+// Schema maps the public name of the filterable fields of a resource to
+// their column.
+type Schema map[string]Field
+
+// Condition is a node of a filter: a comparison of a column with a value
+// already converted to the type of the field. Conditions are and-ed.
+type Condition struct {
+	Column   string
+	Operator Operator
+	Value    any
+}
+
+// Parse reads the filter[field][operator]=value parameters of a request,
+// "filter[field]=value" is short for the eq operator. Fields and operators
+// are checked against the schema, so columns are safe to use in queries.
+func Parse(values url.Values, schema Schema) ([]Condition, error) {
+	var conditions []Condition
+
+	for k, raws := range values {
+		if !strings.HasPrefix(k, "filter[") {
+			continue
+		}
+
+		match := key.FindStringSubmatch(k)
+
+		if match == nil {
+			return nil, fmt.Errorf("%w: malformed parameter %s", ErrInvalid, k)
+		}
+
+		field, ok := schema[match[1]]
+
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown field %s", ErrInvalid, match[1])
+		}
+
+		operator := Operator(match[2])
+
+		if operator == "" {
+			operator = Eq
+		}
+
+		if !slices.Contains(operators[field.Kind], operator) {
+			return nil, fmt.Errorf("%w: operator %s not supported by %s", ErrInvalid, operator, match[1])
+		}
+
+		for _, raw := range raws {
+			value, err := field.value(operator, raw)
+
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", ErrInvalid, k, err)
+			}
+
+			conditions = append(conditions, Condition{Column: field.Column, Operator: operator, Value: value})
+		}
+	}
+
+	// map iteration is random, sorted conditions keep the queries stable.
+	slices.SortFunc(conditions, func(a, b Condition) int {
+		return strings.Compare(a.Column+string(a.Operator), b.Column+string(b.Operator))
+	})
+
+	return conditions, nil
+}
+
+// Apply adds the conditions to tx.
+func Apply(tx *gorm.DB, conditions []Condition) *gorm.DB {
+	for _, c := range conditions {
+		tx = tx.Where(c.expression())
+	}
+	return tx
+}
+
+func (c Condition) expression() clause.Expression {
+	column := clause.Column{Name: c.Column}
+
+	switch c.Operator {
+	case Ne:
+		return clause.Neq{Column: column, Value: c.Value}
+	case Gt:
+		return clause.Gt{Column: column, Value: c.Value}
+	case Gte:
+		return clause.Gte{Column: column, Value: c.Value}
+	case Lt:
+		return clause.Lt{Column: column, Value: c.Value}
+	case Lte:
+		return clause.Lte{Column: column, Value: c.Value}
+	case In:
+		return clause.IN{Column: column, Values: c.Value.([]any)}
+	case Contains:
+		return clause.Like{Column: column, Value: "%" + escape(c.Value.(string)) + "%"}
+	case IsNull:
+		if c.Value.(bool) {
+			return clause.Eq{Column: column, Value: nil}
+		}
+		return clause.Neq{Column: column, Value: nil}
+	default:
+		return clause.Eq{Column: column, Value: c.Value}
+	}
+}
+
+func (f Field) value(operator Operator, raw string) (any, error) {
+	switch operator {
+	case IsNull:
+		null, err := strconv.ParseBool(raw)
+
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return null, nil
+	case Contains:
+		return raw, nil
+	case In:
+		parts := strings.Split(raw, ",")
+
+		if len(parts) > maxValues {
+			return nil, fmt.Errorf("at most %d values", maxValues)
+		}
+
+		values := make([]any, 0, len(parts))
+
+		for _, part := range parts {
+			v, err := f.parse(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	default:
+		return f.parse(raw)
+	}
+}
+
+func (f Field) parse(raw string) (any, error) {
+	switch f.Kind {
+	case Time:
+		if t, err := time.Parse(time.DateOnly, raw); err == nil {
+			return t, nil
+		}
+
+		t, err := time.Parse(time.RFC3339, raw)
+
+		if err != nil {
+			return nil, errors.New("must be a RFC 3339 date")
+		}
+		return t, nil
+	case Int:
+		n, err := strconv.Atoi(raw)
+
+		if err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		return n, nil
+	default:
+		return raw, nil
+	}
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
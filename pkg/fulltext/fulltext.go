@@ -0,0 +1,189 @@
+package fulltext
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// snippetLength is the number of characters of a highlighted snippet.
+	snippetLength = 120
+	// snippetContext is the number of characters kept before the first match.
+	snippetContext = 30
+)
+
+// Index is a MySQL FULLTEXT index over some columns of a table.
+type Index struct {
+	Table   string
+	Columns []string
+}
+
+// Migrate creates the index if it does not exist yet. Matching is accent
+// insensitive through the collation of the columns (utf8mb4_0900_ai_ci,
+// utf8_general_ci).
+func (i Index) Migrate(db *gorm.DB) error {
+	if db.Dialector.Name() != "mysql" {
+		return fmt.Errorf("full text search is not supported by %s", db.Dialector.Name())
+	}
+
+	if db.Migrator().HasIndex(i.Table, i.name()) {
+		return nil
+	}
+	return db.Exec(fmt.Sprintf("CREATE FULLTEXT INDEX %s ON %s (%s)", i.name(), i.Table, strings.Join(i.Columns, ", "))).Error
+}
+
+// Match keeps the rows matching every term of q, as a prefix. Queries
+// without terms match nothing.
+func (i Index) Match(tx *gorm.DB, q string) *gorm.DB {
+	terms := Terms(q)
+
+	if len(terms) == 0 {
+		return tx.Where("1 = 0")
+	}
+
+	return tx.Where(i.Score(tx, q))
+}
+
+// Rank orders the rows by relevance to q, the most relevant first. The
+// relevance is selected as "score", so it can be followed by other orders.
+func (i Index) Rank(tx *gorm.DB, q string) *gorm.DB {
+	return tx.Select(i.Table+".*, ? AS score", i.Score(tx, q)).Order("score DESC")
+}
+
+// Score is the relevance of a row to q, higher is better. Scores of
+// different indexes are not comparable.
+func (i Index) Score(tx *gorm.DB, q string) clause.Expr {
+	return clause.Expr{
+		SQL:  fmt.Sprintf("MATCH(%s) AGAINST (? IN BOOLEAN MODE)", strings.Join(i.Columns, ", ")),
+		Vars: []any{booleanQuery(Terms(q))},
+	}
+}
+
+func (i Index) name() string {
+	return "idx_" + i.Table + "_search"
+}
+
+// Fold lowercases s and removes its accents, "Pérez" -> "perez".
+func Fold(s string) string {
+	folded, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), s)
+
+	if err != nil {
+		return strings.ToLower(s)
+	}
+	return strings.ToLower(folded)
+}
+
+// Terms splits the folded query into words, dropping single characters and
+// any search operator.
+func Terms(q string) []string {
+	var terms []string
+
+	for _, word := range strings.FieldsFunc(Fold(q), func(r rune) bool { return !isWord(r) }) {
+		if len([]rune(word)) > 1 {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// Highlight returns a snippet of text around the first match of the terms
+// of q, with the matches wrapped in <mark></mark> and the rest HTML escaped.
+// It reports false when text does not match.
+func Highlight(text, q string) (string, bool) {
+	terms := Terms(q)
+	original := []rune(text)
+
+	// folded keeps, for every folded rune, the position of its source rune.
+	var (
+		folded []rune
+		source []int
+	)
+
+	for n, r := range original {
+		for _, f := range Fold(string(r)) {
+			folded = append(folded, f)
+			source = append(source, n)
+		}
+	}
+
+	marked := make([]bool, len(original))
+	first := -1
+
+	for n := range folded {
+		if n > 0 && isWord(folded[n-1]) {
+			continue
+		}
+
+		for _, term := range terms {
+			t := []rune(term)
+
+			if n+len(t) > len(folded) || string(folded[n:n+len(t)]) != term {
+				continue
+			}
+
+			for m := n; m < n+len(t); m++ {
+				marked[source[m]] = true
+			}
+
+			if first < 0 || source[n] < first {
+				first = source[n]
+			}
+		}
+	}
+
+	if first < 0 {
+		return "", false
+	}
+
+	start, end := 0, len(original)
+
+	if len(original) > snippetLength {
+		start = max(0, first-snippetContext)
+		end = min(len(original), start+snippetLength)
+	}
+
+	var b strings.Builder
+
+	if start > 0 {
+		b.WriteString("…")
+	}
+
+	for n := start; n < end; n++ {
+		if marked[n] && (n == start || !marked[n-1]) {
+			b.WriteString("<mark>")
+		}
+
+		b.WriteString(html.EscapeString(string(original[n])))
+
+		if marked[n] && (n == end-1 || !marked[n+1]) {
+			b.WriteString("</mark>")
+		}
+	}
+
+	if end < len(original) {
+		b.WriteString("…")
+	}
+
+	return b.String(), true
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// booleanQuery requires every term as a prefix: "+juan* +perez*".
+func booleanQuery(terms []string) string {
+	parts := make([]string, len(terms))
+	for n, term := range terms {
+		parts[n] = "+" + term + "*"
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,162 @@
+package httpcache
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Validate sets the ETag and Last-Modified headers and answers 304 Not
+// Modified when the request preconditions still hold, in which case the
+// caller must not write a body. If-None-Match wins over If-Modified-Since.
+func Validate(w http.ResponseWriter, r *http.Request, tag string, lastModified *time.Time) bool {
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+
+	if lastModified != nil && !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if !matches(header, tag) {
+			return false
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	if header := r.Header.Get("If-Modified-Since"); header != "" && lastModified != nil {
+		since, err := http.ParseTime(header)
+
+		if err != nil || lastModified.Truncate(time.Second).After(since) {
+			return false
+		}
+
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// Tag builds a weak entity tag from the values that identify a
+// representation, e.g. the query and the id and version of each listed row.
+func Tag(values ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(values, "\x00")))
+	return `W/"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Latest returns the most recent of the given times, nil when there is none.
+func Latest(times ...*time.Time) *time.Time {
+	var latest *time.Time
+
+	for _, t := range times {
+		if t != nil && (latest == nil || t.After(*latest)) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// Middleware sets the Cache-Control header of successful and 304 GET
+// responses from the policies indexed by route name, falling back to
+// defaultPolicy. Errors are not cached.
+func Middleware(defaultPolicy string, policies map[string]string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				policy := defaultPolicy
+
+				if route := mux.CurrentRoute(r); route != nil {
+					if p, ok := policies[route.GetName()]; ok {
+						policy = p
+					}
+				}
+
+				if policy != "" {
+					w = &policyWriter{ResponseWriter: w, policy: policy}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// policyWriter sets the Cache-Control header once the status is known.
+type policyWriter struct {
+	http.ResponseWriter
+	policy      string
+	wroteHeader bool
+}
+
+func (p *policyWriter) WriteHeader(status int) {
+	if !p.wroteHeader {
+		p.wroteHeader = true
+
+		if status >= 200 && status < 300 || status == http.StatusNotModified {
+			p.Header().Set("Cache-Control", p.policy)
+			p.Header().Add("Vary", "Authorization")
+		}
+	}
+
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *policyWriter) Write(b []byte) (int, error) {
+	if !p.wroteHeader {
+		p.WriteHeader(http.StatusOK)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (p *policyWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// PoliciesFromEnv reads the Cache-Control policy of every named route from
+// CACHE_CONTROL_<ROUTE NAME>, e.g. CACHE_CONTROL_COURSES_LIST for "courses.list".
+func PoliciesFromEnv(router *mux.Router) map[string]string {
+	policies := make(map[string]string)
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		name := route.GetName()
+		key := "CACHE_CONTROL_" + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+
+		if policy, ok := os.LookupEnv(key); ok && name != "" {
+			policies[name] = policy
+		}
+		return nil
+	})
+
+	return policies
+}
+
+// matches applies the weak comparison of If-None-Match.
+func matches(header, tag string) bool {
+	if tag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/clientip"
+	"github.com/gorilla/mux"
+)
+
+const (
+	Header = "Idempotency-Key"
+	// ReplayedHeader marks the responses replayed from a previous request.
+	ReplayedHeader = "Idempotent-Replayed"
+	// maxKeyLength bounds the keys sent by clients, UUIDs are recommended.
+	maxKeyLength = 255
+	// defaultLease is how long a request keeps its key pending when Lease is
+	// not set, past it the request is considered dead and the key reclaimed.
+	defaultLease = 2 * time.Minute
+)
+
+// stored are the response headers replayed with the body, the others
+// belong to each request (request id, caching).
+var stored = []string{"Content-Type", "Location", "ETag", "Last-Modified"}
+
+type Config struct {
+	Store Store
+	// TTL is how long a key, and the response it replays, is kept.
+	TTL time.Duration
+	// Lease is how long a key stays pending, it must outlast the requests.
+	Lease time.Duration
+	// ProxyHops identifies anonymous clients by IP, see clientip.FromRequest.
+	ProxyHops int
+	// Routes lists the names of the routes accepting the header.
+	Routes []string
+	// Logger gets the errors storing the responses, nil discards them.
+	Logger *log.Logger
+}
+
+// Middleware replays the first response to a request sent with an
+// Idempotency-Key, so clients can safely retry it. Keys are scoped to the
+// principal, or to the client IP for anonymous requests. Reusing a key with a
+// different request is rejected with 422 and retrying while the first
+// request runs with 409. Server errors are not stored, the request can be
+// retried.
+func Middleware(config Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(Header)
+
+			if key == "" || r.Method != http.MethodPost || !config.accepts(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if len(key) > maxKeyLength {
+				writeError(w, http.StatusBadRequest, "idempotency key is too long")
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+
+			var tooLarge *http.MaxBytesError
+
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+				return
+			}
+
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request body")
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			id := hash(config.client(r), key)
+			fingerprint := hash(r.Method, r.URL.Path, r.URL.RawQuery, string(body))
+
+			claim, first, err := config.Store.Begin(id, fingerprint, config.TTL, config.lease())
+
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+
+			if first != nil {
+				replay(w, first, fingerprint)
+				return
+			}
+
+			recorder := &recorder{ResponseWriter: w, status: http.StatusOK}
+			saved := false
+
+			// the key is released when the handler panics too.
+			defer func() {
+				if !saved {
+					config.log(config.Store.Release(claim))
+				}
+			}()
+
+			next.ServeHTTP(recorder, r)
+
+			if recorder.status >= http.StatusInternalServerError {
+				return
+			}
+
+			header := make(map[string]string)
+
+			for _, name := range stored {
+				if value := w.Header().Get(name); value != "" {
+					header[name] = value
+				}
+			}
+
+			encoded, _ := json.Marshal(header)
+
+			claim.Status = recorder.status
+			claim.Header = string(encoded)
+			claim.Body = recorder.body.Bytes()
+			err = config.Store.Save(claim)
+
+			saved = err == nil
+			config.log(err)
+		})
+	}
+}
+
+func replay(w http.ResponseWriter, first *domain.IdempotencyKey, fingerprint string) {
+	if first.Fingerprint != fingerprint {
+		writeError(w, http.StatusUnprocessableEntity, "idempotency key was used with a different request")
+		return
+	}
+
+	if first.Pending() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusConflict, "a request with this idempotency key is in progress")
+		return
+	}
+
+	var header map[string]string
+	json.Unmarshal([]byte(first.Header), &header)
+
+	for name, value := range header {
+		w.Header().Set(name, value)
+	}
+
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(first.Status)
+	w.Write(first.Body)
+}
+
+func (c Config) accepts(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && slices.Contains(c.Routes, route.GetName())
+}
+
+func (c Config) log(err error) {
+	if err != nil && c.Logger != nil {
+		c.Logger.Println(err)
+	}
+}
+
+// client scopes the keys, anonymous clients would share them, and their
+// responses, without the IP.
+func (c Config) client(r *http.Request) string {
+	if p := auth.FromContext(r.Context()); p != nil {
+		return p.Type + ":" + p.ID
+	}
+	return "ip:" + clientip.FromRequest(r, c.ProxyHops)
+}
+
+func (c Config) lease() time.Duration {
+	if c.Lease > 0 {
+		return c.Lease
+	}
+	return defaultLease
+}
+
+func hash(values ...string) string {
+	h := sha256.New()
+
+	for _, v := range values {
+		io.WriteString(h, v)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder keeps a copy of the response while writing it.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Err    string `json:"error"`
+	}{Status: status, Err: message})
+}
@@ -0,0 +1,85 @@
+package idempotency
+
+import (
+	"errors"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/internal/domain"
+	"gorm.io/gorm"
+)
+
+type Store interface {
+	// Begin claims id for a new request and returns its claim. When id is
+	// already claimed, not older than ttl and, while pending, leased less
+	// than lease ago, it returns the record of the first request instead.
+	Begin(id, fingerprint string, ttl, lease time.Duration) (claim, first *domain.IdempotencyKey, err error)
+	// Save stores the response of the request holding the claim, unless it
+	// was reclaimed meanwhile.
+	Save(claim *domain.IdempotencyKey) error
+	// Release frees the claim so the request can be retried.
+	Release(claim *domain.IdempotencyKey) error
+	// PurgeExpired removes the keys older than ttl.
+	PurgeExpired(ttl time.Duration) (int, error)
+}
+
+type store struct {
+	db *gorm.DB
+}
+
+func (s store) Begin(id, fingerprint string, ttl, lease time.Duration) (*domain.IdempotencyKey, *domain.IdempotencyKey, error) {
+	now := time.Now()
+
+	// expired keys, and pending ones whose request died, can be claimed again.
+	err := s.db.Where("id = ? AND (created_at < ? OR (status = 0 AND started_at < ?))", id, now.Add(-ttl), now.Add(-lease)).
+		Delete(&domain.IdempotencyKey{}).Error
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the lease is compared when saving, it is kept as stored.
+	claim := &domain.IdempotencyKey{ID: id, Fingerprint: fingerprint, StartedAt: now.Truncate(time.Millisecond)}
+	err = s.db.Create(claim).Error
+
+	if err == nil {
+		return claim, nil, nil
+	}
+
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		return nil, nil, err
+	}
+
+	var first domain.IdempotencyKey
+
+	if err := s.db.First(&first, "id = ?", id).Error; err != nil {
+		return nil, nil, err
+	}
+	return nil, &first, nil
+}
+
+func (s store) Save(claim *domain.IdempotencyKey) error {
+	return s.db.Model(&domain.IdempotencyKey{}).
+		Where("id = ? AND status = 0 AND started_at = ?", claim.ID, claim.StartedAt).
+		Select("status", "header", "body").
+		Updates(claim).Error
+}
+
+func (s store) Release(claim *domain.IdempotencyKey) error {
+	return s.db.Where("id = ? AND status = 0 AND started_at = ?", claim.ID, claim.StartedAt).
+		Delete(&domain.IdempotencyKey{}).Error
+}
+
+func (s store) PurgeExpired(ttl time.Duration) (int, error) {
+	tx := s.db.Where("created_at < ?", time.Now().Add(-ttl)).Delete(&domain.IdempotencyKey{})
+
+	if tx.Error != nil {
+		return 0, tx.Error
+	}
+	return int(tx.RowsAffected), nil
+}
+
+// NewStore keeps the keys in the idempotency_keys table, the db must
+// translate errors so duplicated keys are detected.
+func NewStore(db *gorm.DB) Store {
+	return &store{db: db}
+}
@@ -0,0 +1,418 @@
+package listing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/meta"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// Order is a column of the ORDER BY clause, ties are always broken by id.
+type Order struct {
+	Column string
+	Desc   bool
+}
+
+// Options tell a repository which page of a list to read: either an offset
+// page or, when Keyset is set, the page after (or before) Cursor.
+type Options struct {
+	Offset int
+	Limit  int
+	Sort   []Order
+	Keyset bool
+	Cursor *meta.Cursor
+}
+
+// ErrInvalidCursor is returned for cursors that can not be decoded or were
+// created for another sort.
+var ErrInvalidCursor = meta.ErrInvalidCursor
+
+var ErrInvalidSort = errors.New("invalid sort")
+
+var schemas sync.Map
+
+// ParseSort reads a sort parameter such as "last_name,-created_at", a "-"
+// prefix sorts descending. Only the sortable fields are accepted, so the
+// result is safe to use as column names; fallback is used when raw is empty.
+func ParseSort(raw string, sortable []string, fallback []Order) ([]Order, error) {
+	if strings.TrimSpace(raw) == "" {
+		return fallback, nil
+	}
+
+	var (
+		sort []Order
+		seen = map[string]bool{}
+	)
+
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		o := Order{Column: strings.TrimPrefix(part, "-"), Desc: strings.HasPrefix(part, "-")}
+
+		if !slices.Contains(sortable, o.Column) {
+			return nil, fmt.Errorf("%w: %q is not sortable, use one of %s", ErrInvalidSort, o.Column, strings.Join(sortable, ", "))
+		}
+
+		if seen[o.Column] {
+			return nil, fmt.Errorf("%w: %q is repeated", ErrInvalidSort, o.Column)
+		}
+
+		seen[o.Column] = true
+		sort = append(sort, o)
+	}
+
+	return sort, nil
+}
+
+// New reads the pagination of a list request. Keyset pagination is used
+// when the request has a cursor parameter (empty for the first page), it
+// only counts the rows when count=true. Offset pagination always counts.
+func New(values url.Values, sort []Order, count func() (int, error)) (*meta.Meta, Options, error) {
+	limit, _ := strconv.Atoi(values.Get("limit"))
+	opts := Options{Sort: sort}
+
+	if !values.Has("cursor") {
+		total, err := count()
+
+		if err != nil {
+			return nil, opts, err
+		}
+
+		page, _ := strconv.Atoi(values.Get("page"))
+		m, err := meta.New(page, limit, total)
+
+		if err != nil {
+			return nil, opts, err
+		}
+
+		m.Sort = signature(sort)
+		opts.Offset, opts.Limit = m.Offset(), m.Limit()
+		return m, opts, nil
+	}
+
+	cursor, err := meta.DecodeCursor(values.Get("cursor"))
+
+	if err != nil {
+		return nil, opts, err
+	}
+
+	if len(sort) == 0 {
+		return nil, opts, fmt.Errorf("%w: keyset pagination needs a sort", ErrInvalidCursor)
+	}
+
+	if cursor != nil && cursor.Sort != signature(sort) {
+		return nil, opts, meta.ErrInvalidCursor
+	}
+
+	total := -1
+
+	if values.Get("count") == "true" {
+		if total, err = count(); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	m, err := meta.NewKeyset(limit, total)
+
+	if err != nil {
+		return nil, opts, err
+	}
+
+	m.Sort = signature(sort)
+	opts.Keyset, opts.Cursor, opts.Limit = true, cursor, m.Limit()
+	return m, opts, nil
+}
+
+// Apply adds the order and the page to tx, whose model must be set. Keyset
+// pages read one more row to know whether there is a next one, see Page.
+func Apply(tx *gorm.DB, opts Options) (*gorm.DB, error) {
+	backward := opts.Cursor != nil && opts.Cursor.Backward
+	columns := append(append([]Order{}, opts.Sort...), Order{Column: "id", Desc: idDesc(opts.Sort)})
+
+	for _, o := range columns {
+		tx = tx.Order(clause.OrderByColumn{Column: clause.Column{Name: o.Column}, Desc: o.Desc != backward})
+	}
+
+	if !opts.Keyset {
+		return tx.Limit(opts.Limit).Offset(opts.Offset), nil
+	}
+
+	if opts.Cursor != nil {
+		condition, args, err := after(tx, columns, opts.Cursor)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tx = tx.Where(condition, args...)
+	}
+
+	return tx.Limit(opts.Limit + 1), nil
+}
+
+// Page drops the extra row read by a keyset query and sets the cursors of
+// the neighbour pages in m.
+func Page[T any](rows []T, opts Options, m *meta.Meta) ([]T, error) {
+	if !opts.Keyset {
+		return rows, nil
+	}
+
+	backward := opts.Cursor != nil && opts.Cursor.Backward
+	more := len(rows) > opts.Limit
+
+	if more {
+		rows = rows[:opts.Limit]
+	}
+
+	if backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	if len(rows) == 0 {
+		return rows, nil
+	}
+
+	if more || backward {
+		next, err := cursorOf(rows[len(rows)-1], opts.Sort, false)
+		if err != nil {
+			return nil, err
+		}
+		m.Next = next
+	}
+
+	if (more && backward) || (opts.Cursor != nil && !backward) {
+		prev, err := cursorOf(rows[0], opts.Sort, true)
+		if err != nil {
+			return nil, err
+		}
+		m.Prev = prev
+	}
+
+	return rows, nil
+}
+
+// after builds the keyset condition "row comes after the cursor" for the
+// given order: (a > ?) OR (a = ? AND b < ?) OR ... depending on directions.
+func after(tx *gorm.DB, columns []Order, cursor *meta.Cursor) (string, []any, error) {
+	if len(cursor.Values) != len(columns)-1 {
+		return "", nil, meta.ErrInvalidCursor
+	}
+
+	if err := tx.Statement.Parse(tx.Statement.Model); err != nil {
+		return "", nil, err
+	}
+
+	values := make([]any, len(columns))
+
+	for i, raw := range cursor.Values {
+		value, err := parse(tx.Statement.Schema, columns[i].Column, raw)
+		if err != nil {
+			return "", nil, meta.ErrInvalidCursor
+		}
+		values[i] = value
+	}
+
+	values[len(columns)-1] = cursor.ID
+
+	var (
+		branches []string
+		args     []any
+	)
+
+	for i, o := range columns {
+		var parts []string
+
+		for j := 0; j < i; j++ {
+			parts = append(parts, quote(tx, columns[j].Column)+" = ?")
+			args = append(args, values[j])
+		}
+
+		operator := ">"
+		if o.Desc != cursor.Backward {
+			operator = "<"
+		}
+
+		parts = append(parts, quote(tx, o.Column)+" "+operator+" ?")
+		args = append(args, values[i])
+		branches = append(branches, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	return strings.Join(branches, " OR "), args, nil
+}
+
+func cursorOf(row any, sort []Order, backward bool) (string, error) {
+	s, err := schema.Parse(row, &schemas, schema.NamingStrategy{})
+
+	if err != nil {
+		return "", err
+	}
+
+	value := reflect.ValueOf(row)
+	c := meta.Cursor{Sort: signature(sort), Backward: backward}
+
+	for _, o := range sort {
+		field := s.LookUpField(o.Column)
+
+		if field == nil {
+			return "", fmt.Errorf("unknown column %s", o.Column)
+		}
+
+		v, _ := field.ValueOf(context.Background(), value)
+		c.Values = append(c.Values, format(v))
+	}
+
+	id, _ := s.PrioritizedPrimaryField.ValueOf(context.Background(), value)
+	c.ID = format(id)
+
+	return meta.EncodeCursor(c), nil
+}
+
+// parse converts a cursor value back to the type of its column, so dates are
+// compared as dates by the database.
+func parse(s *schema.Schema, column, raw string) (any, error) {
+	field := s.LookUpField(column)
+
+	if field == nil {
+		return nil, fmt.Errorf("unknown column %s", column)
+	}
+
+	switch field.FieldType {
+	case reflect.TypeOf(time.Time{}), reflect.TypeOf(&time.Time{}):
+		return time.Parse(time.RFC3339Nano, raw)
+	}
+
+	switch field.DataType {
+	case schema.Int, schema.Uint:
+		return strconv.ParseInt(raw, 10, 64)
+	case schema.Float:
+		return strconv.ParseFloat(raw, 64)
+	}
+
+	return raw, nil
+}
+
+func format(v any) string {
+	switch t := v.(type) {
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	case *time.Time:
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// signature identifies a sort, cursors are only valid for the sort they
+// were created with.
+func signature(sort []Order) string {
+	parts := make([]string, 0, len(sort))
+
+	for _, o := range sort {
+		if o.Desc {
+			parts = append(parts, "-"+o.Column)
+		} else {
+			parts = append(parts, o.Column)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func idDesc(sort []Order) bool {
+	return len(sort) > 0 && sort[len(sort)-1].Desc
+}
+
+func quote(tx *gorm.DB, column string) string {
+	return tx.Statement.Quote(column)
+}
+
+// Link fills the links of m from the request URL, keeping its filters and
+// sort, and sends them in the Link header (RFC 8288).
+func Link(w http.ResponseWriter, r *http.Request, m *meta.Meta) {
+	at := func(key, value string) string {
+		values := r.URL.Query()
+		values.Set(key, value)
+		values.Set("limit", strconv.Itoa(m.PerPage))
+		return (&url.URL{Path: r.URL.Path, RawQuery: values.Encode()}).String()
+	}
+
+	links := &meta.Links{Self: r.URL.RequestURI()}
+
+	if m.Page > 0 {
+		last := 1
+		if m.PageCount != nil && *m.PageCount > 1 {
+			last = *m.PageCount
+		}
+
+		links.First = at("page", "1")
+		links.Last = at("page", strconv.Itoa(last))
+
+		if m.Page > 1 {
+			links.Prev = at("page", strconv.Itoa(m.Page-1))
+		}
+		if m.Page < last {
+			links.Next = at("page", strconv.Itoa(m.Page+1))
+		}
+	} else {
+		links.First = at("cursor", "")
+
+		if m.Prev != "" {
+			links.Prev = at("cursor", m.Prev)
+		}
+		if m.Next != "" {
+			links.Next = at("cursor", m.Next)
+		}
+	}
+
+	m.Links = links
+
+	var header []string
+
+	for _, link := range []struct{ rel, url string }{
+		{"self", links.Self},
+		{"first", links.First},
+		{"prev", links.Prev},
+		{"next", links.Next},
+		{"last", links.Last},
+	} {
+		if link.url != "" {
+			header = append(header, fmt.Sprintf(`<%s>; rel="%s"`, link.url, link.rel))
+		}
+	}
+
+	w.Header().Set("Link", strings.Join(header, ", "))
+}
+
+// ParseTimeFilters reads the RFC 3339 updated_since and created_before
+// filters shared by the lists.
+func ParseTimeFilters(query url.Values, updatedSince, createdBefore **time.Time) error {
+	for key, dest := range map[string]**time.Time{"updated_since": updatedSince, "created_before": createdBefore} {
+		if query.Get(key) == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, query.Get(key))
+
+		if err != nil {
+			return errors.New(key + " must be a RFC 3339 date")
+		}
+
+		*dest = &t
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (m smtpMailer) Send(to, subject, body string) error {
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, message(m.from, to, subject, body))
+}
+
+// NewSMTP sends mails through an SMTP server, PLAIN auth is only used when a
+// username is given.
+func NewSMTP(host, port, username, password, from string) Mailer {
+	var auth smtp.Auth
+
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &smtpMailer{addr: host + ":" + port, auth: auth, from: from}
+}
+
+type writerMailer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func (m *writerMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.w, "%s\n", message(m.from, to, subject, body))
+	return err
+}
+
+// NewWriter writes every mail to w (a log file, stdout...) instead of
+// delivering it, so the flows can be exercised without a mail server.
+func NewWriter(w io.Writer, from string) Mailer {
+	return &writerMailer{w: w, from: from}
+}
+
+func message(from, to, subject, body string) []byte {
+	headers := []string{
+		"From: " + from,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body + "\r\n")
+}
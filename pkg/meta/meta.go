@@ -1,15 +1,45 @@
 package meta
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"os"
 	"strconv"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Meta describes a page. Offset pages have a number and counts; keyset
+// pages have the opaque Next/Prev cursors and are only counted on demand.
 type Meta struct {
-	Page       int `json:"page"`
-	PerPage    int `json:"per_page"`
-	PageCount  int `json:"page_count"`
-	TotalCount int `json:"total_count"`
+	Page       int    `json:"page,omitempty"`
+	PerPage    int    `json:"per_page"`
+	PageCount  *int   `json:"page_count,omitempty"`
+	TotalCount *int   `json:"total_count,omitempty"`
+	Sort       string `json:"sort,omitempty"`
+	Next       string `json:"next,omitempty"`
+	Prev       string `json:"prev,omitempty"`
+	Links      *Links `json:"links,omitempty"`
+}
+
+// Links are the URLs of the current page and its neighbours, keyset pages
+// have no last link.
+type Links struct {
+	Self  string `json:"self"`
+	First string `json:"first,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+	Next  string `json:"next,omitempty"`
+	Last  string `json:"last,omitempty"`
+}
+
+// Cursor points at the row a keyset page starts after (or before, when
+// Backward): the values of its sort columns and its id.
+type Cursor struct {
+	Sort     string   `json:"s"`
+	Values   []string `json:"v"`
+	ID       string   `json:"id"`
+	Backward bool     `json:"b,omitempty"`
 }
 
 func (m Meta) Offset() int {
@@ -21,12 +51,10 @@ func (m Meta) Limit() int {
 }
 
 func New(page, perPage, total int) (*Meta, error) {
-	if perPage <= 0 {
-		var err error
-		perPage, err = strconv.Atoi(os.Getenv("PAGINATOR_LIMIT_DEFAULT"))
-		if err != nil {
-			return nil, err
-		}
+	perPage, err := limit(perPage)
+
+	if err != nil {
+		return nil, err
 	}
 
 	pageCount := 0
@@ -45,7 +73,65 @@ func New(page, perPage, total int) (*Meta, error) {
 	return &Meta{
 		Page:       page,
 		PerPage:    perPage,
-		TotalCount: total,
-		PageCount:  pageCount,
+		TotalCount: &total,
+		PageCount:  &pageCount,
 	}, nil
 }
+
+// NewKeyset creates the meta of a keyset page, total is ignored when negative.
+func NewKeyset(perPage, total int) (*Meta, error) {
+	perPage, err := limit(perPage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Meta{PerPage: perPage}
+
+	if total >= 0 {
+		pageCount := (total + perPage - 1) / perPage
+		m.TotalCount, m.PageCount = &total, &pageCount
+	}
+
+	return m, nil
+}
+
+func EncodeCursor(c Cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// DecodeCursor returns nil for an empty string, the first page.
+func DecodeCursor(encoded string) (*Cursor, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+
+	if err := json.Unmarshal(raw, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// limit falls back to PAGINATOR_LIMIT_DEFAULT and caps the page size at
+// PAGINATOR_LIMIT_MAX, when set.
+func limit(perPage int) (int, error) {
+	if perPage <= 0 {
+		return strconv.Atoi(os.Getenv("PAGINATOR_LIMIT_DEFAULT"))
+	}
+
+	if max, err := strconv.Atoi(os.Getenv("PAGINATOR_LIMIT_MAX")); err == nil && max > 0 && perPage > max {
+		return max, nil
+	}
+
+	return perPage, nil
+}
@@ -0,0 +1,86 @@
+package password
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	algorithm  = "pbkdf2-sha256"
+	iterations = 600000
+	saltLength = 16
+	keyLength  = 32
+	MinLength  = 8
+)
+
+var (
+	ErrTooShort      = fmt.Errorf("password must have at least %d characters", MinLength)
+	ErrInvalidFormat = errors.New("invalid password hash format")
+)
+
+// Hash returns an encoded "pbkdf2-sha256$<iterations>$<salt>$<key>" hash.
+func Hash(plain string) (string, error) {
+	if len(plain) < MinLength {
+		return "", ErrTooShort
+	}
+
+	salt := make([]byte, saltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, plain, salt, iterations, keyLength)
+
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		algorithm,
+		strconv.Itoa(iterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+func Compare(hash, plain string) (bool, error) {
+	parts := strings.Split(hash, "$")
+
+	if len(parts) != 4 || parts[0] != algorithm {
+		return false, ErrInvalidFormat
+	}
+
+	iter, err := strconv.Atoi(parts[1])
+
+	if err != nil {
+		return false, ErrInvalidFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return false, ErrInvalidFormat
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+
+	if err != nil {
+		return false, ErrInvalidFormat
+	}
+
+	key, err := pbkdf2.Key(sha256.New, plain, salt, iter, len(expected))
+
+	if err != nil {
+		return false, err
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1, nil
+}
@@ -0,0 +1,47 @@
+package phone
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+var (
+	ErrInvalid       = errors.New("invalid phone number")
+	ErrUnknownRegion = errors.New("unknown phone region")
+)
+
+// CheckRegion verifies that region is an ISO 3166-1 alpha-2 code known to
+// the numbering plans, so national numbers can be read.
+func CheckRegion(region string) error {
+	if phonenumbers.GetCountryCodeForRegion(strings.ToUpper(region)) == 0 {
+		return ErrUnknownRegion
+	}
+	return nil
+}
+
+// Normalize converts a phone number into E.164 ("+5491122334455"), checked
+// against the numbering plan of its country. Numbers without an
+// international prefix ("+" or "00") are national numbers of the region.
+func Normalize(raw, region string) (string, error) {
+	raw = strings.TrimSpace(raw)
+
+	if strings.HasPrefix(raw, "00") {
+		raw = "+" + raw[2:]
+	}
+
+	if !strings.HasPrefix(raw, "+") {
+		if err := CheckRegion(region); err != nil {
+			return "", err
+		}
+	}
+
+	number, err := phonenumbers.Parse(raw, strings.ToUpper(region))
+
+	if err != nil || !phonenumbers.IsValidNumber(number) {
+		return "", ErrInvalid
+	}
+
+	return phonenumbers.Format(number, phonenumbers.E164), nil
+}
@@ -0,0 +1,31 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		raw, region, want string
+		err               error
+	}{
+		{"+54 9 11 2233-4455", "", "+5491122334455", nil},
+		{"0054 9 11 2233-4455", "", "+5491122334455", nil},
+		{"011 15-2233-4455", "AR", "+5491122334455", nil},
+		{"(202) 555-0143", "us", "+12025550143", nil},
+		{"612 34 56 78", "ES", "+34612345678", nil},
+		{"11 2233-4455", "", "", ErrUnknownRegion},
+		{"11 2233-4455", "XX", "", ErrUnknownRegion},
+		{"123", "AR", "", ErrInvalid},
+		{"+54 11 abc", "AR", "", ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		got, err := Normalize(tt.raw, tt.region)
+
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Normalize(%q, %q) = %q, %v; want %q, %v", tt.raw, tt.region, got, err, tt.want, tt.err)
+		}
+	}
+}
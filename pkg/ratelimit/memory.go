@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often the memory store forgets the full buckets.
+const sweepEvery = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// refill adds the tokens earned since the last update.
+func (b *bucket) refill(now time.Time) {
+	rate := float64(b.limit.Requests) / b.limit.Period.Seconds()
+	b.tokens = math.Min(float64(b.limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+}
+
+type memory struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func (m *memory) Take(key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(m.swept) > sweepEvery {
+		m.sweep(now)
+	}
+
+	b, ok := m.buckets[key]
+
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Requests), updated: now, limit: limit}
+		m.buckets[key] = b
+	}
+
+	b.refill(now)
+
+	rate := float64(limit.Requests) / limit.Period.Seconds()
+	result := Result{Allowed: b.tokens >= 1}
+
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = wait(1-b.tokens, rate)
+	}
+
+	result.Remaining = int(b.tokens)
+	result.Reset = wait(float64(limit.Requests)-b.tokens, rate)
+
+	return result, nil
+}
+
+// sweep drops the buckets that are full again, they are the same as new ones.
+func (m *memory) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Requests) {
+			delete(m.buckets, key)
+		}
+	}
+	m.swept = now
+}
+
+// wait is the time needed to earn tokens.
+func wait(tokens, rate float64) time.Duration {
+	return time.Duration(tokens / rate * float64(time.Second))
+}
+
+// NewMemoryStore keeps the buckets in the process, each instance of the
+// API enforces its own limits.
+func NewMemoryStore() Store {
+	return &memory{buckets: make(map[string]*bucket), swept: time.Now()}
+}
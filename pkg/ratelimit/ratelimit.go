@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/auth"
+	"github.com/S3ergio31/curso-go-seccion-4/pkg/clientip"
+	"github.com/gorilla/mux"
+)
+
+var (
+	ErrInvalidLimit     = errors.New("invalid rate limit, use requests/period as in 100/1m")
+	ErrInvalidProxyHops = errors.New("invalid proxy hops, use the number of trusted proxies")
+)
+
+// Limit allows Requests per Period, in bursts of up to Requests. The zero
+// Limit does not limit anything.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Result is the state of a bucket after taking a token from it.
+type Result struct {
+	Allowed   bool
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until the next token, when not allowed.
+	RetryAfter time.Duration
+}
+
+// Store keeps the token buckets, a shared store lets several instances
+// enforce the same limits.
+type Store interface {
+	Take(key string, limit Limit) (Result, error)
+}
+
+type Config struct {
+	Store Store
+	// Default applies to the routes without their own limit.
+	Default Limit
+	// Routes are the limits indexed by route name, each route gets its own
+	// buckets.
+	Routes map[string]Limit
+	// ProxyHops is the number of trusted proxies in front of the server, see
+	// clientip.FromRequest.
+	ProxyHops int
+	// Logger gets the errors of the store, nil discards them.
+	Logger *log.Logger
+}
+
+// ParseLimit reads a limit as "requests/period", e.g. "100/1m". An empty
+// limit or "off" disables it.
+func ParseLimit(raw string) (Limit, error) {
+	if raw == "" || raw == "off" {
+		return Limit{}, nil
+	}
+
+	requests, period, ok := strings.Cut(raw, "/")
+
+	if !ok {
+		return Limit{}, ErrInvalidLimit
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(requests))
+
+	if err != nil || n <= 0 {
+		return Limit{}, ErrInvalidLimit
+	}
+
+	d, err := time.ParseDuration(strings.TrimSpace(period))
+
+	if err != nil || d <= 0 {
+		return Limit{}, ErrInvalidLimit
+	}
+
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// ParseProxyHops reads the number of trusted proxies, empty means none.
+func ParseProxyHops(raw string) (int, error) {
+	if raw == "" {
+		return 0, nil
+	}
+
+	hops, err := strconv.Atoi(strings.TrimSpace(raw))
+
+	if err != nil || hops < 0 {
+		return 0, ErrInvalidProxyHops
+	}
+	return hops, nil
+}
+
+// LimitsFromEnv reads the limit of every named route from
+// RATE_LIMIT_<ROUTE NAME>, e.g. RATE_LIMIT_USERS_LIST for "users.list".
+func LimitsFromEnv(router *mux.Router) (map[string]Limit, error) {
+	limits := make(map[string]Limit)
+
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		name := route.GetName()
+		key := "RATE_LIMIT_" + strings.ToUpper(strings.ReplaceAll(name, ".", "_"))
+
+		if raw, ok := os.LookupEnv(key); ok && name != "" {
+			limit, err := ParseLimit(raw)
+
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			limits[name] = limit
+		}
+		return nil
+	})
+
+	return limits, err
+}
+
+// Middleware limits the requests of every client, identified by its
+// principal or its IP when anonymous, with token buckets. Registered before
+// auth.Middleware every client is identified by its IP, so credentials can
+// not be guessed without limits. Responses carry the RateLimit-* headers,
+// rejected ones a 429 with Retry-After. Requests are let through when the
+// store fails.
+func Middleware(config Config) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, bucket := config.Default, "default"
+
+			if route := mux.CurrentRoute(r); route != nil {
+				if l, ok := config.Routes[route.GetName()]; ok {
+					limit, bucket = l, route.GetName()
+				}
+			}
+
+			if limit.Requests == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			result, err := config.Store.Take(bucket+"|"+config.client(r), limit)
+
+			if err != nil {
+				if config.Logger != nil {
+					config.Logger.Println(err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, seconds(limit.Period)))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Requests))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+				writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// client identifies who sends the request: its API key, its user or its IP.
+func (c Config) client(r *http.Request) string {
+	if p := auth.FromContext(r.Context()); p != nil {
+		return p.Type + ":" + p.ID
+	}
+
+	return "ip:" + clientip.FromRequest(r, c.ProxyHops)
+}
+
+// seconds rounds d up, headers never announce a 0 wait that is not over.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Status int    `json:"status"`
+		Err    string `json:"error"`
+	}{Status: status, Err: message})
+}
@@ -0,0 +1,24 @@
+package uow
+
+import "gorm.io/gorm"
+
+// UnitOfWork runs several repository calls, possibly from different
+// packages, in one transaction. Repositories and services join it through
+// their WithTx method.
+type UnitOfWork interface {
+	// Do commits when fn returns nil and rolls back when it returns an error
+	// or panics.
+	Do(fn func(tx *gorm.DB) error) error
+}
+
+type unitOfWork struct {
+	db *gorm.DB
+}
+
+func (u unitOfWork) Do(fn func(tx *gorm.DB) error) error {
+	return u.db.Transaction(fn)
+}
+
+func New(db *gorm.DB) UnitOfWork {
+	return &unitOfWork{db: db}
+}